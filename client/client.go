@@ -0,0 +1,1073 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package client implements a Go client for talking to a `takeanumber` server.
+
+A Client keeps a pool of idle connections, dialing new ones as needed. Every
+call accepts a context.Context, which bounds how long the call may take. Calls
+on a connection that the server has dropped are retried on a fresh
+connection.
+
+For a complete description of the available commands, responses & errors, see
+the included Protocol.md document that is included with `takeanumber`.
+*/
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// An error for when there are no items in the queue.
+var EmptyQueue = errors.New("No items available to reserve.")
+
+// An error for when the provided body is empty.
+var EmptyBody = errors.New("No body provided.")
+
+// An error for when an item has used all of its retries.
+var NoRetries = errors.New("No retries remaining.")
+
+// An error for when the requested Id is not in the queue.
+var NoSuchId = errors.New("No such Id.")
+
+// An error for when an item is not reserved.
+var NotReserved = errors.New("Item is not reserved.")
+
+// An error for when a receipt doesn't match the item's current reservation.
+var StaleReceipt = errors.New("Stale receipt.")
+
+// An error for when the server requires the client to AUTH first.
+var NoAuth = errors.New("NOAUTH Authentication required.")
+
+// An error for when the server rejects the client's credentials.
+var WrongPass = errors.New("WRONGPASS Invalid username or password.")
+
+// An error for when the client's user isn't permitted to run a command.
+var NoPerm = errors.New("NOPERM Not permitted to run this command on this queue.")
+
+// An error for when a body is larger than the server allows.
+var BodyTooLarge = errors.New("Body too large.")
+
+// An error for when a command is larger than the server allows.
+var CommandTooLarge = errors.New("Command too large.")
+
+// An error for when an item can't be moved because it's reserved.
+var StillReserved = errors.New("Item is reserved.")
+
+// An error for when moving an item would split it from the rest of its group.
+var SplitGroup = errors.New("Item's group has other items in the queue.")
+
+// An error for when an item's Id is already in the queue.
+var DuplicateId = errors.New("Duplicate Id.")
+
+// An error for when a provided Id isn't usable.
+var InvalidId = errors.New("Invalid Id.")
+
+// An error for when a provided group isn't usable.
+var InvalidGroup = errors.New("Invalid group.")
+
+// An error for when a provided attribute isn't usable.
+var InvalidAttribute = errors.New("Invalid attribute.")
+
+// An error for when a body contains a line break, which would end the
+// command early.
+var InvalidBody = errors.New("Body contains a line break.")
+
+// An error for when a queue name, Id, key or receipt is empty or contains
+// whitespace, which would split it into several parameters.
+var InvalidParameter = errors.New("Invalid parameter.")
+
+// An error for when the Client has been closed.
+var ClientClosed = errors.New("Client is closed.")
+
+// The known errors, keyed by the message the server sends.
+var serverErrors = map[string]error{
+	EmptyQueue.Error():       EmptyQueue,
+	EmptyBody.Error():        EmptyBody,
+	NoRetries.Error():        NoRetries,
+	NoSuchId.Error():         NoSuchId,
+	NotReserved.Error():      NotReserved,
+	StaleReceipt.Error():     StaleReceipt,
+	NoAuth.Error():           NoAuth,
+	WrongPass.Error():        WrongPass,
+	NoPerm.Error():           NoPerm,
+	BodyTooLarge.Error():     BodyTooLarge,
+	CommandTooLarge.Error():  CommandTooLarge,
+	StillReserved.Error():    StillReserved,
+	SplitGroup.Error():       SplitGroup,
+	DuplicateId.Error():      DuplicateId,
+	InvalidId.Error():        InvalidId,
+	InvalidGroup.Error():     InvalidGroup,
+	InvalidAttribute.Error(): InvalidAttribute,
+}
+
+// The notices the server sends just before it drops a connection. One may be
+// left waiting on an idle connection, ahead of the response to the next
+// command.
+var dropNotices = map[string]bool{
+	"-ERR Idle timeout.\r\n":         true,
+	"-ERR Server shutting down.\r\n": true,
+}
+
+// An Item reserved from a queue.
+//
+// Attributes is nil if the item has no attributes.
+type Item struct {
+	Id         string
+	Receipt    string
+	Body       string
+	Attributes map[string]string
+}
+
+// An item found by Scan.
+//
+// Bodies longer than the server's limit for SCAN are truncated.
+type Entry struct {
+	Id    string
+	State string
+	Body  string
+}
+
+// The filters for Scan. Zero values don't filter anything.
+type ScanOptions struct {
+	State  string
+	MinAge time.Duration
+	MaxAge time.Duration
+	Count  int
+}
+
+// The options for AddWith. Zero values are left out.
+//
+// If an item was added to the queue with the same Key within the server's
+// deduplication window, no new item is added. If Id is set, the item is given
+// that Id instead of one generated by the server. Items with the same Group
+// are reserved one at a time, in the order they were added. The Attributes
+// are kept alongside the body & returned by Reserve.
+type AddOptions struct {
+	Key        string
+	Id         string
+	Group      string
+	Attributes map[string]string
+}
+
+// A queue, as listed by Queues.
+type QueueInfo struct {
+	Name   string
+	Len    int
+	Paused bool
+}
+
+// A single connection to the server.
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// The number of idle connections kept in the pool.
+const MaxIdle = 8
+
+// The Client itself.
+//
+// Network is "tcp" by default. To talk to a server over a Unix domain socket,
+// set Network to "unix" & Addr to the socket's path.
+//
+// If TLSConfig is set, connections are made using TLS. If Password is set,
+// each connection authenticates with it (as Username, if set) when it's made.
+type Client struct {
+	Network   string
+	Addr      string
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	idle      chan *conn
+	lock      *sync.Mutex
+	closed    bool
+}
+
+// Fetches an idle connection from the pool, or dials a new one.
+//
+// Returns the connection, whether it was reused from the pool (bool) & any
+// error from dialing.
+func (c *Client) get(ctx context.Context) (*conn, bool, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, true, nil
+	default:
+	}
+
+	var nc net.Conn
+	var err error
+
+	if c.TLSConfig != nil {
+		d := &tls.Dialer{Config: c.TLSConfig}
+		nc, err = d.DialContext(ctx, c.Network, c.Addr)
+	} else {
+		d := &net.Dialer{}
+		nc, err = d.DialContext(ctx, c.Network, c.Addr)
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	cn := &conn{nc, bufio.NewReader(nc)}
+
+	if err := c.auth(ctx, cn); err != nil {
+		cn.Close()
+		return nil, false, err
+	}
+
+	return cn, false, nil
+}
+
+// Authenticates a new connection, if the Client has a Password.
+func (c *Client) auth(ctx context.Context, cn *conn) error {
+	if c.Password == "" {
+		return nil
+	}
+
+	if err := checkParams(c.Password); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("AUTH %s", c.Password)
+
+	if c.Username != "" {
+		if err := checkParams(c.Username); err != nil {
+			return err
+		}
+
+		command = fmt.Sprintf("AUTH %s %s", c.Username, c.Password)
+	}
+
+	line, err := c.roundTrip(ctx, cn, command)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = decode(line)
+	return err
+}
+
+// Returns a connection to the pool, closing it if the pool is full or the
+// Client has been closed.
+func (c *Client) put(cn *conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		cn.Close()
+		return
+	}
+
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// Sends a command on a connection & reads back the raw response line.
+//
+// The connection's deadline is taken from the context, falling back to the
+// Client's Timeout. Cancelling the context interrupts the call.
+func (c *Client) roundTrip(ctx context.Context, cn *conn, command string) (string, error) {
+	deadline, ok := ctx.Deadline()
+
+	if !ok && c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+
+	cn.SetDeadline(deadline)
+
+	stop := make(chan bool)
+	exited := make(chan bool)
+
+	defer func() {
+		close(stop)
+		<-exited
+	}()
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-ctx.Done():
+			cn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	_, err := io.WriteString(cn, command+"\r\n")
+
+	if err != nil {
+		return "", err
+	}
+
+	line, err := cn.reader.ReadString('\n')
+
+	if err != nil || !strings.HasPrefix(line, "*") {
+		return line, err
+	}
+
+	// An array is followed by a line for each of its values.
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	for n := 0; n < count; n++ {
+		value, err := cn.reader.ReadString('\n')
+		line += value
+
+		if err != nil {
+			return line, err
+		}
+	}
+
+	return line, nil
+}
+
+// Checks that each parameter is a single, non-empty word, so that it can't
+// be split up (or end the command early) when it's sent.
+//
+// Returns an InvalidParameter error if not.
+func checkParams(params ...string) error {
+	for _, param := range params {
+		if param == "" || strings.IndexFunc(param, unicode.IsSpace) >= 0 {
+			return InvalidParameter
+		}
+	}
+
+	return nil
+}
+
+// Sends a command to the server & returns the decoded response.
+//
+// If a pooled connection turns out to have been dropped by the server, the
+// command is sent again on another connection.
+//
+// Returns a string (for `+` responses) or an integer (for `:` responses). An
+// `-ERR` response is returned as an error.
+func (c *Client) do(ctx context.Context, command string) (interface{}, error) {
+	c.lock.Lock()
+	closed := c.closed
+	c.lock.Unlock()
+
+	if closed {
+		return nil, ClientClosed
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		cn, reused, err := c.get(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		line, err := c.roundTrip(ctx, cn, command)
+
+		if err != nil {
+			cn.Close()
+
+			if ctxErr := contextErr(ctx); ctxErr != nil {
+				return nil, ctxErr
+			}
+
+			if reused && line == "" && isBrokenConn(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		// The server dropped the connection while it sat in the pool, so
+		// the command was never run.
+		if reused && dropNotices[line] {
+			cn.Close()
+			continue
+		}
+
+		c.put(cn)
+		return decode(line)
+	}
+}
+
+// Returns the context's error, including when its deadline has passed but the
+// context hasn't noticed yet.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// Returns if an error means the server closed the connection.
+func isBrokenConn(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+// Decodes a raw response from the server.
+//
+// Returns a string (for `+` responses), an integer (for `:` responses) or a
+// slice of strings (for `*` responses). An `-ERR` response is returned as an
+// error.
+func decode(line string) (interface{}, error) {
+	line = strings.TrimRight(line, "\r\n")
+
+	if len(line) == 0 {
+		return nil, errors.New("Empty response.")
+	}
+
+	switch line[0] {
+	case '*':
+		lines := strings.Split(line, "\r\n")[1:]
+		values := []string{}
+
+		for _, raw := range lines {
+			value, err := decode(raw)
+
+			if err != nil {
+				return nil, err
+			}
+
+			str, ok := value.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("Unexpected response: %s", raw)
+			}
+
+			values = append(values, str)
+		}
+
+		return values, nil
+	case '+':
+		return line[1:], nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '-':
+		msg := strings.TrimPrefix(line[1:], "ERR ")
+
+		if err, ok := serverErrors[msg]; ok {
+			return nil, err
+		}
+
+		return nil, errors.New(msg)
+	}
+
+	return nil, fmt.Errorf("Unexpected response: %s", line)
+}
+
+// Sends a command that is expected to respond with "OK".
+func (c *Client) doOK(ctx context.Context, command string) error {
+	resp, err := c.do(ctx, command)
+
+	if err != nil {
+		return err
+	}
+
+	if resp != "OK" {
+		return fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	return nil
+}
+
+// Fetches the length of a queue.
+//
+// Accepts the name (string) of the queue.
+//
+// Returns the number of unreserved items (integer).
+func (c *Client) Len(ctx context.Context, queue string) (int, error) {
+	if err := checkParams(queue); err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(ctx, fmt.Sprintf("LEN %s", queue))
+
+	if err != nil {
+		return 0, err
+	}
+
+	length, ok := resp.(int)
+
+	if !ok {
+		return 0, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	return length, nil
+}
+
+// Adds an item to the end of a queue.
+//
+// Accepts the name (string) of the queue, the body (string) & the number of
+// times it can be retried (integer).
+//
+// Returns the new item's Id (string). If the body is empty, an EmptyBody error
+// is returned.
+func (c *Client) Add(ctx context.Context, queue string, body string, retries int) (string, error) {
+	return c.AddWith(ctx, queue, body, retries, AddOptions{})
+}
+
+// Adds an item to the end of a queue, with options.
+//
+// Accepts the name (string) of the queue, the body (string), the number of
+// times it can be retried (integer) & the AddOptions.
+//
+// Returns the new item's Id (string), or the original item's Id if the Key
+// was already used. If the body is empty, an EmptyBody error is returned, if
+// it contains a line break, an InvalidBody error, if the Id is already in the
+// queue, a DuplicateId error & if an attribute is malformed, an
+// InvalidAttribute error. Queue names, keys, Ids & groups that are empty or
+// contain whitespace return an InvalidParameter error.
+func (c *Client) AddWith(ctx context.Context, queue string, body string, retries int, opts AddOptions) (string, error) {
+	if len(strings.TrimSpace(body)) <= 0 {
+		return "", EmptyBody
+	}
+
+	if strings.ContainsAny(body, "\r\n") {
+		return "", InvalidBody
+	}
+
+	if err := checkParams(queue); err != nil {
+		return "", err
+	}
+
+	command := fmt.Sprintf("ADD %s", queue)
+
+	// Each option's value must be a single word, like the queue name.
+	for _, value := range []string{opts.Key, opts.Id, opts.Group} {
+		if value != "" {
+			if err := checkParams(value); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if opts.Key != "" {
+		command = fmt.Sprintf("%s KEY %s", command, opts.Key)
+	}
+
+	if opts.Id != "" {
+		command = fmt.Sprintf("%s ID %s", command, opts.Id)
+	}
+
+	if opts.Group != "" {
+		command = fmt.Sprintf("%s GROUP %s", command, opts.Group)
+	}
+
+	names := []string{}
+
+	for name := range opts.Attributes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := opts.Attributes[name]
+
+		// Whitespace would split the attribute up, so catch it before
+		// it's sent.
+		if strings.Contains(name, "=") || strings.IndexFunc(name+value, unicode.IsSpace) >= 0 {
+			return "", InvalidAttribute
+		}
+
+		command = fmt.Sprintf("%s ATTR %s=%s", command, name, value)
+	}
+
+	// The options come before the retries, so the body is sent as-is.
+	resp, err := c.do(ctx, fmt.Sprintf("%s %d %s", command, retries, body))
+
+	if err != nil {
+		return "", err
+	}
+
+	id, ok := resp.(string)
+
+	if !ok {
+		return "", fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	return id, nil
+}
+
+// Reserves an item from the front of a queue.
+//
+// Accepts the name (string) of the queue & how long (time.Duration) the
+// reservation should last. A timeout of zero uses the server's default.
+//
+// Returns the reserved Item, including its attributes. If the queue has no
+// items available, an EmptyQueue error is returned.
+func (c *Client) Reserve(ctx context.Context, queue string, timeout time.Duration) (*Item, error) {
+	if err := checkParams(queue); err != nil {
+		return nil, err
+	}
+
+	command := fmt.Sprintf("RESERVE %s", queue)
+
+	if timeout > 0 {
+		command = fmt.Sprintf("%s %d", command, seconds(timeout))
+	}
+
+	resp, err := c.do(ctx, command+" ATTRS")
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := resp.([]string)
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	bits := strings.SplitN(values[0], " ", 3)
+
+	if len(bits) != 3 {
+		return nil, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	i := &Item{Id: bits[0], Receipt: bits[1], Body: bits[2]}
+
+	for _, value := range values[1:] {
+		pair := strings.SplitN(value, "=", 2)
+
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected response: %v", value)
+		}
+
+		if i.Attributes == nil {
+			i.Attributes = map[string]string{}
+		}
+
+		i.Attributes[pair[0]] = pair[1]
+	}
+
+	return i, nil
+}
+
+// Fetches the next items in a queue, *without* reserving them.
+//
+// Accepts the name (string) of the queue & the most items (integer) to fetch.
+//
+// Returns the Items, which have no Receipt since they aren't reserved.
+func (c *Client) Peek(ctx context.Context, queue string, count int) ([]*Item, error) {
+	if err := checkParams(queue); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, fmt.Sprintf("PEEK %s %d", queue, count))
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := resp.([]string)
+
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	items := []*Item{}
+
+	for _, value := range values {
+		bits := strings.SplitN(value, " ", 2)
+
+		if len(bits) != 2 {
+			return nil, fmt.Errorf("Unexpected response: %v", value)
+		}
+
+		items = append(items, &Item{Id: bits[0], Body: bits[1]})
+	}
+
+	return items, nil
+}
+
+// Fetches the full state of an item, whatever state it's in.
+//
+// Accepts the name (string) of the queue & the Id (string) of the item.
+//
+// Returns the item's fields (such as "state", "remaining_retries" & "body"),
+// keyed by name. Attributes are keyed by "attr." & their name. If the item isn't in the queue, a NoSuchId error is returned.
+func (c *Client) Inspect(ctx context.Context, queue string, id string) (map[string]string, error) {
+	if err := checkParams(queue, id); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, fmt.Sprintf("INSPECT %s %s", queue, id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _ := resp.(string)
+	fields := map[string]string{}
+
+	for raw != "" {
+		if strings.HasPrefix(raw, "body=") {
+			fields["body"] = strings.TrimPrefix(raw, "body=")
+			break
+		}
+
+		bits := strings.SplitN(raw, " ", 2)
+		pair := strings.SplitN(bits[0], "=", 2)
+
+		if len(pair) != 2 || len(bits) != 2 {
+			return nil, fmt.Errorf("Unexpected response: %v", resp)
+		}
+
+		fields[pair[0]] = pair[1]
+		raw = bits[1]
+	}
+
+	return fields, nil
+}
+
+// Scans through the items in a queue, a batch at a time.
+//
+// Accepts the name (string) of the queue, a cursor (uint64) & the filters to
+// apply. The first call should use a cursor of zero; each call returns the
+// cursor for the next, which is zero once the end of the queue is reached.
+//
+// Returns the matching Entries & the next cursor (uint64).
+func (c *Client) Scan(ctx context.Context, queue string, cursor uint64, opts ScanOptions) ([]*Entry, uint64, error) {
+	if err := checkParams(queue); err != nil {
+		return nil, 0, err
+	}
+
+	command := fmt.Sprintf("SCAN %s %d", queue, cursor)
+
+	if opts.State != "" {
+		if err := checkParams(opts.State); err != nil {
+			return nil, 0, err
+		}
+
+		command = fmt.Sprintf("%s STATE %s", command, opts.State)
+	}
+
+	if opts.MinAge > 0 {
+		command = fmt.Sprintf("%s MINAGE %d", command, seconds(opts.MinAge))
+	}
+
+	if opts.MaxAge > 0 {
+		command = fmt.Sprintf("%s MAXAGE %d", command, seconds(opts.MaxAge))
+	}
+
+	if opts.Count > 0 {
+		command = fmt.Sprintf("%s COUNT %d", command, opts.Count)
+	}
+
+	resp, err := c.do(ctx, command)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values, ok := resp.([]string)
+
+	if !ok || len(values) == 0 {
+		return nil, 0, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	next, err := strconv.ParseUint(values[0], 10, 64)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	entries := []*Entry{}
+
+	for _, value := range values[1:] {
+		bits := strings.SplitN(value, " ", 3)
+
+		if len(bits) != 3 {
+			return nil, 0, fmt.Errorf("Unexpected response: %v", value)
+		}
+
+		entries = append(entries, &Entry{bits[0], bits[1], bits[2]})
+	}
+
+	return entries, next, nil
+}
+
+// Removes the items in a queue.
+//
+// Accepts the name (string) of the queue & which items (string) to remove:
+// "ready" (any that aren't reserved), "reserved" or "all".
+//
+// Returns the number of items removed (integer).
+func (c *Client) Purge(ctx context.Context, queue string, state string) (int, error) {
+	if err := checkParams(queue); err != nil {
+		return 0, err
+	}
+
+	if state != "" {
+		if err := checkParams(state); err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := c.do(ctx, fmt.Sprintf("PURGE %s %s", queue, state))
+
+	if err != nil {
+		return 0, err
+	}
+
+	purged, ok := resp.(int)
+
+	if !ok {
+		return 0, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	return purged, nil
+}
+
+// Removes an item, whatever state it's in.
+//
+// Accepts the name (string) of the queue & the Id (string) of the item. If
+// the item isn't in the queue, a NoSuchId error is returned.
+func (c *Client) Remove(ctx context.Context, queue string, id string) error {
+	if err := checkParams(queue, id); err != nil {
+		return err
+	}
+
+	_, err := c.do(ctx, fmt.Sprintf("REMOVE %s %s", queue, id))
+	return err
+}
+
+// Moves items from one queue to the end of another.
+//
+// Accepts the names (string) of the source & destination queues & the most
+// items (integer) to move (zero moves them all). Reserved items aren't moved.
+//
+// Returns the number of items moved (integer).
+func (c *Client) Move(ctx context.Context, src string, dst string, count int) (int, error) {
+	if err := checkParams(src, dst); err != nil {
+		return 0, err
+	}
+
+	command := fmt.Sprintf("MOVE %s %s", src, dst)
+
+	if count > 0 {
+		command = fmt.Sprintf("%s %d", command, count)
+	}
+
+	resp, err := c.do(ctx, command)
+
+	if err != nil {
+		return 0, err
+	}
+
+	moved, ok := resp.(int)
+
+	if !ok {
+		return 0, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	return moved, nil
+}
+
+// Moves a single item from one queue to the end of another.
+//
+// Accepts the names (string) of the source & destination queues & the Id
+// (string) of the item. If the item isn't in the source queue, a NoSuchId
+// error is returned, if it's reserved, a StillReserved error & if other items
+// in its group are still in the source queue, a SplitGroup error.
+func (c *Client) MoveId(ctx context.Context, src string, dst string, id string) error {
+	if err := checkParams(src, dst, id); err != nil {
+		return err
+	}
+
+	_, err := c.do(ctx, fmt.Sprintf("MOVE %s %s ID %s", src, dst, id))
+	return err
+}
+
+// Pauses a queue, so that nothing can be reserved from it until it's resumed.
+//
+// Accepts the name (string) of the queue. Items can still be added while
+// it's paused.
+func (c *Client) Pause(ctx context.Context, queue string) error {
+	if err := checkParams(queue); err != nil {
+		return err
+	}
+
+	return c.doOK(ctx, fmt.Sprintf("PAUSE %s", queue))
+}
+
+// Resumes a paused queue.
+//
+// Accepts the name (string) of the queue.
+func (c *Client) Resume(ctx context.Context, queue string) error {
+	if err := checkParams(queue); err != nil {
+		return err
+	}
+
+	return c.doOK(ctx, fmt.Sprintf("RESUME %s", queue))
+}
+
+// Lists the server's queues.
+//
+// Returns the QueueInfo for each queue, in alphabetical order.
+func (c *Client) Queues(ctx context.Context) ([]QueueInfo, error) {
+	resp, err := c.do(ctx, "QUEUES")
+
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := resp.([]string)
+
+	if !ok {
+		return nil, fmt.Errorf("Unexpected response: %v", resp)
+	}
+
+	queues := []QueueInfo{}
+
+	for _, value := range values {
+		info := QueueInfo{}
+		paused := ""
+		_, err := fmt.Sscanf(value, "%s len=%d paused=%s", &info.Name, &info.Len, &paused)
+
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected response: %v", value)
+		}
+
+		info.Paused = paused == "true"
+		queues = append(queues, info)
+	}
+
+	return queues, nil
+}
+
+// Extends the reservation on an item.
+//
+// Accepts the name (string) of the queue, the Id (string) & receipt (string)
+// of the item & the new timeout (time.Duration). A timeout of zero uses the
+// server's default.
+func (c *Client) Touch(ctx context.Context, queue string, id string, receipt string, timeout time.Duration) error {
+	if err := checkParams(queue, id, receipt); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("TOUCH %s %s %s", queue, id, receipt)
+
+	if timeout > 0 {
+		command = fmt.Sprintf("%s %d", command, seconds(timeout))
+	}
+
+	return c.doOK(ctx, command)
+}
+
+// Marks an item to be retried.
+//
+// Accepts the name (string) of the queue & the Id (string) & receipt (string)
+// of the item. If the item has used all of its retries, it is removed & a
+// NoRetries error is returned.
+func (c *Client) Retry(ctx context.Context, queue string, id string, receipt string) error {
+	if err := checkParams(queue, id, receipt); err != nil {
+		return err
+	}
+
+	return c.doOK(ctx, fmt.Sprintf("RETRY %s %s %s", queue, id, receipt))
+}
+
+// Releases an item without using one of its retries.
+//
+// Accepts the name (string) of the queue, the Id (string) & receipt (string)
+// of the item & how long (time.Duration) to wait before it can be reserved
+// again.
+func (c *Client) Release(ctx context.Context, queue string, id string, receipt string, delay time.Duration) error {
+	if err := checkParams(queue, id, receipt); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("RELEASE %s %s %s", queue, id, receipt)
+
+	if delay > 0 {
+		command = fmt.Sprintf("%s %d", command, seconds(delay))
+	}
+
+	return c.doOK(ctx, command)
+}
+
+// Marks an item as completed.
+//
+// Accepts the name (string) of the queue & the Id (string) & receipt (string)
+// of the item.
+func (c *Client) Done(ctx context.Context, queue string, id string, receipt string) error {
+	if err := checkParams(queue, id, receipt); err != nil {
+		return err
+	}
+
+	return c.doOK(ctx, fmt.Sprintf("DONE %s %s %s", queue, id, receipt))
+}
+
+// Closes the Client & all of its idle connections.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+
+	for {
+		select {
+		case cn := <-c.idle:
+			io.WriteString(cn, "CLOSE\r\n")
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Rounds a duration up to whole seconds, for use in commands.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// New creates a new Client instance.
+//
+// Accepts the address (string) of the server, such as "localhost:13331".
+// Connections are made lazily, as commands are sent.
+func New(addr string) *Client {
+	idle := make(chan *conn, MaxIdle)
+	lock := &sync.Mutex{}
+	return &Client{
+		Network: "tcp",
+		Addr:    addr,
+		Timeout: 30 * time.Second,
+		idle:    idle,
+		lock:    lock,
+	}
+}
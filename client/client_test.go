@@ -0,0 +1,452 @@
+package client_test
+
+import (
+	"context"
+	"github.com/toastdriven/takeanumber/client"
+	"github.com/toastdriven/takeanumber/server"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs an in-process server on an ephemeral port.
+//
+// Returns the address it's listening on & a func that drops every connection
+// made so far.
+func startServer(t *testing.T) (string, func()) {
+	s := server.New(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	lock := &sync.Mutex{}
+	conns := []net.Conn{}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			lock.Lock()
+			conns = append(conns, c)
+			lock.Unlock()
+
+			go s.Handle(c)
+		}
+	}()
+
+	t.Cleanup(func() { l.Close() })
+
+	drop := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, c := range conns {
+			c.Close()
+		}
+
+		conns = nil
+	}
+
+	return l.Addr().String(), drop
+}
+
+func TestClient(t *testing.T) {
+	addr, _ := startServer(t)
+	c := client.New(addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	length, err := c.Len(ctx, "test_queue")
+
+	if err != nil || length != 0 {
+		t.Error("Queue should be empty, saw:", length, err)
+	}
+
+	if _, err := c.Reserve(ctx, "test_queue", 0); err != client.EmptyQueue {
+		t.Error("Expected EmptyQueue, saw:", err)
+	}
+
+	if _, err := c.Add(ctx, "test_queue", " ", 0); err != client.EmptyBody {
+		t.Error("Expected EmptyBody, saw:", err)
+	}
+
+	id, err := c.Add(ctx, "test_queue", "Hello, world!", 1)
+
+	if err != nil || id == "" {
+		t.Error("Add failed:", err)
+	}
+
+	keyed, err := c.AddWith(ctx, "test_queue", "KEY looks like an option", 1, client.AddOptions{Key: "hello"})
+
+	if err != nil || keyed == id {
+		t.Error("AddWith failed:", keyed, err)
+	}
+
+	if again, _ := c.AddWith(ctx, "test_queue", "Hello, world!", 1, client.AddOptions{Key: "hello"}); again != keyed {
+		t.Error("A duplicate AddWith should return the original Id, saw:", again)
+	}
+
+	if fields, _ := c.Inspect(ctx, "test_queue", keyed); fields["body"] != "KEY looks like an option" {
+		t.Error("The body should be sent as-is, saw:", fields)
+	}
+
+	c.Remove(ctx, "test_queue", keyed)
+
+	if own, err := c.AddWith(ctx, "test_queue", "Mine", 0, client.AddOptions{Id: "order-1"}); err != nil || own != "order-1" {
+		t.Error("AddWith an Id failed:", own, err)
+	}
+
+	if _, err := c.AddWith(ctx, "test_queue", "Mine", 0, client.AddOptions{Id: "order-1"}); err != client.DuplicateId {
+		t.Error("Expected DuplicateId, saw:", err)
+	}
+
+	c.Remove(ctx, "test_queue", "order-1")
+
+	attrs := map[string]string{"trace": "abc", "tenant": "7"}
+
+	if _, err := c.AddWith(ctx, "other_queue", "Tagged", 0, client.AddOptions{Attributes: attrs}); err != nil {
+		t.Error("AddWith attributes failed:", err)
+	}
+
+	if tagged, err := c.Reserve(ctx, "other_queue", 0); err != nil || tagged.Body != "Tagged" || len(tagged.Attributes) != 2 || tagged.Attributes["trace"] != "abc" || tagged.Attributes["tenant"] != "7" {
+		t.Error("Reserve should return the attributes, saw:", tagged, err)
+	} else {
+		c.Done(ctx, "other_queue", tagged.Id, tagged.Receipt)
+	}
+
+	if _, err := c.AddWith(ctx, "other_queue", "Tagged", 0, client.AddOptions{Attributes: map[string]string{"a": "b c"}}); err != client.InvalidAttribute {
+		t.Error("Expected InvalidAttribute, saw:", err)
+	}
+
+	c.AddWith(ctx, "other_queue", "First", 0, client.AddOptions{Group: "user-a"})
+	c.AddWith(ctx, "other_queue", "Second", 0, client.AddOptions{Group: "user-a"})
+
+	if grouped, err := c.Reserve(ctx, "other_queue", 0); err != nil || grouped.Body != "First" {
+		t.Error("Reserve should return the first item in the group, saw:", grouped, err)
+	} else if _, err := c.Reserve(ctx, "other_queue", 0); err != client.EmptyQueue {
+		t.Error("The group should be held back while its item is reserved, saw:", err)
+	} else {
+		c.Done(ctx, "other_queue", grouped.Id, grouped.Receipt)
+	}
+
+	if grouped, err := c.Reserve(ctx, "other_queue", 0); err != nil || grouped.Body != "Second" {
+		t.Error("Reserve should move on through the group, saw:", grouped, err)
+	} else {
+		c.Done(ctx, "other_queue", grouped.Id, grouped.Receipt)
+	}
+
+	if _, err := c.AddWith(ctx, "other_queue", "Bad", 0, client.AddOptions{Group: "caf\u00e9"}); err != client.InvalidGroup {
+		t.Error("Expected InvalidGroup, saw:", err)
+	}
+
+	length, _ = c.Len(ctx, "test_queue")
+
+	if length != 1 {
+		t.Error("Queue length is wrong, expected 1, got:", length)
+	}
+
+	peeked, err := c.Peek(ctx, "test_queue", 5)
+
+	if err != nil || len(peeked) != 1 || peeked[0].Id != id || peeked[0].Body != "Hello, world!" {
+		t.Error("Peek returned the wrong items, saw:", peeked, err)
+	}
+
+	fields, err := c.Inspect(ctx, "test_queue", id)
+
+	if err != nil || fields["state"] != "ready" || fields["remaining_retries"] != "1" || fields["body"] != "Hello, world!" {
+		t.Error("Inspect returned the wrong state, saw:", fields, err)
+	}
+
+	if _, err := c.Inspect(ctx, "test_queue", "nope"); err != client.NoSuchId {
+		t.Error("Expected NoSuchId, saw:", err)
+	}
+
+	entries, cursor, err := c.Scan(ctx, "test_queue", 0, client.ScanOptions{State: "ready", Count: 5})
+
+	if err != nil || len(entries) != 1 || entries[0].Id != id || entries[0].State != "ready" || cursor != 0 {
+		t.Error("Scan returned the wrong items, saw:", entries, cursor, err)
+	}
+
+	i, err := c.Reserve(ctx, "test_queue", time.Minute)
+
+	if err != nil {
+		t.Fatal("Reserve failed:", err)
+	}
+
+	if i.Id != id || i.Body != "Hello, world!" || i.Receipt == "" {
+		t.Error("Reserved the wrong item, saw:", i)
+	}
+
+	if err := c.Touch(ctx, "test_queue", i.Id, i.Receipt, time.Minute); err != nil {
+		t.Error("Touch failed:", err)
+	}
+
+	if err := c.Done(ctx, "test_queue", i.Id, "nope"); err != client.StaleReceipt {
+		t.Error("Expected StaleReceipt, saw:", err)
+	}
+
+	if err := c.Retry(ctx, "test_queue", i.Id, i.Receipt); err != nil {
+		t.Error("Retry failed:", err)
+	}
+
+	i, _ = c.Reserve(ctx, "test_queue", 0)
+
+	if err := c.Retry(ctx, "test_queue", i.Id, i.Receipt); err != client.NoRetries {
+		t.Error("Expected NoRetries, saw:", err)
+	}
+
+	if err := c.Done(ctx, "test_queue", i.Id, i.Receipt); err != client.NoSuchId {
+		t.Error("Expected NoSuchId, saw:", err)
+	}
+
+	id, _ = c.Add(ctx, "test_queue", "Again", 0)
+	i, _ = c.Reserve(ctx, "test_queue", 0)
+
+	if err := c.Release(ctx, "test_queue", i.Id, i.Receipt, 0); err != nil {
+		t.Error("Release failed:", err)
+	}
+
+	i, _ = c.Reserve(ctx, "test_queue", 0)
+
+	if err := c.Done(ctx, "test_queue", i.Id, i.Receipt); err != nil {
+		t.Error("Done failed:", err)
+	}
+
+	id, _ = c.Add(ctx, "test_queue", "Removed", 0)
+
+	if err := c.Remove(ctx, "test_queue", id); err != nil {
+		t.Error("Remove failed:", err)
+	}
+
+	if err := c.Remove(ctx, "test_queue", id); err != client.NoSuchId {
+		t.Error("Expected NoSuchId, saw:", err)
+	}
+
+	id, _ = c.Add(ctx, "test_queue", "Moved", 0)
+
+	if err := c.MoveId(ctx, "test_queue", "other_queue", id); err != nil {
+		t.Error("MoveId failed:", err)
+	}
+
+	if moved, err := c.Move(ctx, "other_queue", "test_queue", 0); err != nil || moved != 1 {
+		t.Error("Move failed:", moved, err)
+	}
+
+	c.Add(ctx, "test_queue", "Purged", 0)
+
+	if purged, err := c.Purge(ctx, "test_queue", "all"); err != nil || purged != 2 {
+		t.Error("Purge failed:", purged, err)
+	}
+
+	if err := c.Pause(ctx, "test_queue"); err != nil {
+		t.Error("Pause failed:", err)
+	}
+
+	queues, err := c.Queues(ctx)
+
+	if err != nil || len(queues) != 2 || queues[1].Name != "test_queue" || !queues[1].Paused {
+		t.Error("Queues returned the wrong queues, saw:", queues, err)
+	}
+
+	if err := c.Resume(ctx, "test_queue"); err != nil {
+		t.Error("Resume failed:", err)
+	}
+
+	c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != client.ClientClosed {
+		t.Error("Expected ClientClosed, saw:", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	addr, drop := startServer(t)
+	c := client.New(addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Add(ctx, "test_queue", "Hello", 0); err != nil {
+		t.Fatal("Add failed:", err)
+	}
+
+	drop()
+
+	length, err := c.Len(ctx, "test_queue")
+
+	if err != nil || length != 1 {
+		t.Error("Didn't reconnect, saw:", length, err)
+	}
+}
+
+func TestClientInjection(t *testing.T) {
+	addr, _ := startServer(t)
+	c := client.New(addr)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Add(ctx, "test_queue", "Hello", 0); err != nil {
+		t.Fatal("Add failed:", err)
+	}
+
+	if _, err := c.Add(ctx, "test_queue", "hello\r\nPURGE test_queue all", 0); err != client.InvalidBody {
+		t.Error("A body with a line break should be rejected, got:", err)
+	}
+
+	if _, err := c.Add(ctx, "test_queue 0 x\r\nPURGE", "Hello", 0); err != client.InvalidParameter {
+		t.Error("A queue name with whitespace should be rejected, got:", err)
+	}
+
+	if _, err := c.AddWith(ctx, "test_queue", "Hello", 0, client.AddOptions{Key: "a b"}); err != client.InvalidParameter {
+		t.Error("A key with whitespace should be rejected, got:", err)
+	}
+
+	if err := c.Done(ctx, "test_queue", "1", "r\tPURGE"); err != client.InvalidParameter {
+		t.Error("A receipt with whitespace should be rejected, got:", err)
+	}
+
+	if err := c.Remove(ctx, "test_queue", ""); err != client.InvalidParameter {
+		t.Error("An empty Id should be rejected, got:", err)
+	}
+
+	length, err := c.Len(ctx, "test_queue")
+
+	if err != nil || length != 1 {
+		t.Error("Nothing should have reached the server, saw:", length, err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	// A server that accepts connections but never responds.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			defer c.Close()
+		}
+	}()
+
+	c := client.New(l.Addr().String())
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Len(ctx, "test_queue"); err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded, saw:", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := c.Len(ctx, "test_queue"); err != context.Canceled {
+		t.Error("Expected Canceled, saw:", err)
+	}
+}
+
+func TestClientSocket(t *testing.T) {
+	s := server.New(0)
+	s.Socket = filepath.Join(t.TempDir(), "takeanumber.sock")
+	l, err := s.ListenSocket()
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	c := client.New(s.Socket)
+	c.Network = "unix"
+	defer c.Close()
+
+	length, err := c.Len(context.Background(), "test_queue")
+
+	if err != nil || length != 0 {
+		t.Error("Len over the socket failed, saw:", length, err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	s := server.New(0)
+	s.Password = "letmein"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+	ctx := context.Background()
+
+	c := client.New(l.Addr().String())
+	defer c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != client.NoAuth {
+		t.Error("Expected NoAuth, saw:", err)
+	}
+
+	c = client.New(l.Addr().String())
+	c.Password = "wrong"
+	defer c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != client.WrongPass {
+		t.Error("Expected WrongPass, saw:", err)
+	}
+
+	c = client.New(l.Addr().String())
+	c.Password = "letmein"
+	defer c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != nil {
+		t.Error("Len with a password failed:", err)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	s := server.New(0)
+	s.IdleTimeout = 200 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	ctx := context.Background()
+	c := client.New(l.Addr().String())
+	defer c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != nil {
+		t.Fatal("Len failed:", err)
+	}
+
+	// Let the server drop the pooled connection, leaving its notice behind.
+	time.Sleep(400 * time.Millisecond)
+
+	if length, err := c.Len(ctx, "test_queue"); err != nil || length != 0 {
+		t.Error("Len should reconnect after an idle timeout, saw:", length, err)
+	}
+}
@@ -0,0 +1,40 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/toastdriven/takeanumber/client"
+	"time"
+)
+
+func ExampleClient() {
+	c := client.New("localhost:13331")
+	defer c.Close()
+
+	// Bound how long each call may take.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Add an item with 3 retries.
+	id, err := c.Add(ctx, "my_queue", "Hello, world!", 3)
+
+	if err != nil {
+		// Bad things happened. Bail out.
+	}
+
+	fmt.Println(id)
+
+	// Reserve it for up to a minute.
+	i, err := c.Reserve(ctx, "my_queue", time.Minute)
+
+	if err == client.EmptyQueue {
+		// Nothing to do right now.
+	}
+
+	// Mark it as done, using the receipt from the reservation.
+	err = c.Done(ctx, "my_queue", i.Id, i.Receipt)
+
+	if err == nil {
+		// Huzzah, time to celebrate!
+	}
+}
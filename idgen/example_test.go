@@ -0,0 +1,23 @@
+package idgen_test
+
+import (
+	"fmt"
+	"github.com/toastdriven/takeanumber/idgen"
+)
+
+func ExampleGenerator() {
+	// Pick a generator by name, such as from a flag.
+	g, err := idgen.New("ulid")
+
+	if err != nil {
+		// Unknown generator. Bail out.
+	}
+
+	// Ids made later sort after those made earlier.
+	fmt.Println(g.Next("my_queue"))
+
+	// Ticket numbers count up separately for each queue.
+	tickets := idgen.NewSequence()
+	fmt.Println(tickets.Next("my_queue"))
+	fmt.Println(tickets.Next("other_queue"))
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package idgen implements the generators used to create item Ids.
+
+Random (version 4) UUIDs are the default. The other generators create Ids
+that sort in the order they were created: time-ordered (version 7) UUIDs,
+ULIDs & plain per-queue "ticket numbers".
+*/
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Generator creates Ids for the items added to a queue.
+type Generator interface {
+	Next(queue string) string
+}
+
+// A Func is a function used as a Generator.
+type Func func(queue string) string
+
+// Returns the next Id for an item in a queue.
+func (f Func) Next(queue string) string {
+	return f(queue)
+}
+
+// Fills a buffer with random bytes.
+func random(buf []byte) {
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("idgen: couldn't read random bytes: %v", err))
+	}
+}
+
+// Formats 16 bytes as a hyphenated UUID string.
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+// Creates a random (version 4) UUID.
+//
+// The queue is ignored, so that UUID4 can be used as a Func.
+//
+// Returns the UUID (string).
+func UUID4(queue string) string {
+	b := make([]byte, 16)
+	random(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// A clock that never goes backwards & counts the Ids made within each
+// millisecond, so that the Ids it's used for keep sorting in order.
+type clock struct {
+	lock   *sync.Mutex
+	lastMs uint64
+	count  uint64
+}
+
+// Returns the current time (in milliseconds) & how many Ids have already been
+// made in that millisecond.
+//
+// Once count reaches max, the clock moves on to the next millisecond early.
+func (c *clock) tick(max uint64) (uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+
+	if ms > c.lastMs {
+		c.lastMs = ms
+		c.count = 0
+		return c.lastMs, c.count
+	}
+
+	c.count++
+
+	if c.count > max {
+		c.lastMs++
+		c.count = 0
+	}
+
+	return c.lastMs, c.count
+}
+
+// A UUID7 generator creates time-ordered (version 7) UUIDs.
+//
+// Ids made within the same millisecond are numbered, so that they still sort
+// in the order they were made.
+type UUID7 struct {
+	clock *clock
+}
+
+// Returns the next UUID (string). The queue is ignored.
+func (g *UUID7) Next(queue string) string {
+	ms, count := g.clock.tick(0xfff)
+	b := make([]byte, 16)
+	random(b[8:])
+	binary.BigEndian.PutUint64(b[0:8], ms<<16|count)
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// NewUUID7 creates a new UUID7 instance.
+func NewUUID7() *UUID7 {
+	return &UUID7{&clock{lock: &sync.Mutex{}}}
+}
+
+// The alphabet ULIDs are encoded with (Crockford's base 32).
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// A ULID generator creates ULIDs.
+//
+// A ULID is 26 characters long: a 48 bit timestamp (in milliseconds) followed
+// by 80 random bits. Ids made within the same millisecond are numbered, so
+// that they still sort in the order they were made.
+type ULID struct {
+	clock *clock
+}
+
+// Returns the next ULID (string). The queue is ignored.
+func (g *ULID) Next(queue string) string {
+	ms, count := g.clock.tick(0xffff)
+	b := make([]byte, 16)
+	random(b[8:])
+	binary.BigEndian.PutUint64(b[0:8], ms<<16|count)
+
+	// Encode the 128 bits as 26 characters of 5 bits each (the first
+	// character only gets 3).
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	out := make([]byte, 26)
+
+	for n := 25; n >= 0; n-- {
+		out[n] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out)
+}
+
+// NewULID creates a new ULID instance.
+func NewULID() *ULID {
+	return &ULID{&clock{lock: &sync.Mutex{}}}
+}
+
+// A Sequence generator numbers the items in each queue 1, 2, 3... like the
+// tickets at a deli counter.
+//
+// The numbers only live as long as the Sequence, so they start again from 1
+// when the server restarts.
+type Sequence struct {
+	lock     *sync.Mutex
+	counters map[string]uint64
+}
+
+// Returns the next number (string) for the queue.
+func (g *Sequence) Next(queue string) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.counters[queue]++
+	return strconv.FormatUint(g.counters[queue], 10)
+}
+
+// NewSequence creates a new Sequence instance.
+func NewSequence() *Sequence {
+	return &Sequence{&sync.Mutex{}, map[string]uint64{}}
+}
+
+// The names of the built-in generators, as accepted by New.
+var Names = []string{"uuid4", "uuid7", "ulid", "sequence"}
+
+// New creates one of the built-in generators by name.
+//
+// Accepts the name (string), one of "uuid4", "uuid7", "ulid" or "sequence".
+//
+// Returns the Generator, or an error if there's no such generator.
+func New(name string) (Generator, error) {
+	switch name {
+	case "uuid4":
+		return Func(UUID4), nil
+	case "uuid7":
+		return NewUUID7(), nil
+	case "ulid":
+		return NewULID(), nil
+	case "sequence":
+		return NewSequence(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown Id generator %q.", name)
+}
@@ -0,0 +1,62 @@
+package idgen_test
+
+import (
+	"github.com/toastdriven/takeanumber/idgen"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+var uuid4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+var uuid7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+var ulid = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+
+// Creates a batch of Ids & checks they're well formed, unique & (if ordered)
+// sorted in the order they were made.
+func check(t *testing.T, name string, format *regexp.Regexp, ordered bool) {
+	g, err := idgen.New(name)
+
+	if err != nil {
+		t.Fatal("Couldn't create generator: ", err)
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+
+	for n := 0; n < 5000; n++ {
+		id := g.Next("test_queue")
+
+		if !format.MatchString(id) {
+			t.Fatalf("%s created a malformed Id: %s", name, id)
+		}
+
+		if seen[id] {
+			t.Fatalf("%s created a duplicate Id: %s", name, id)
+		}
+
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	if ordered && !sort.StringsAreSorted(ids) {
+		t.Errorf("%s created Ids out of order", name)
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	check(t, "uuid4", uuid4, false)
+	check(t, "uuid7", uuid7, true)
+	check(t, "ulid", ulid, true)
+
+	if _, err := idgen.New("nope"); err == nil {
+		t.Error("An unknown generator should fail.")
+	}
+}
+
+func TestSequence(t *testing.T) {
+	g := idgen.NewSequence()
+
+	if g.Next("a") != "1" || g.Next("a") != "2" || g.Next("b") != "1" || g.Next("a") != "3" {
+		t.Error("Sequences should count up per queue.")
+	}
+}
@@ -6,8 +6,8 @@
 package item
 
 import (
-	"code.google.com/p/go-uuid/uuid"
 	"errors"
+	"github.com/toastdriven/takeanumber/idgen"
 	"strings"
 	"time"
 )
@@ -15,7 +15,31 @@ import (
 // An error for when the provided body is empty.
 var EmptyBody = errors.New("No body provided.")
 
+// An error for when a provided Id isn't usable.
+var InvalidId = errors.New("Invalid Id.")
+
+// An error for when a provided group isn't usable.
+var InvalidGroup = errors.New("Invalid group.")
+
+// An error for when a provided attribute isn't usable.
+var InvalidAttribute = errors.New("Invalid attribute.")
+
+// The longest Id that may be provided.
+const MaxIdLength = 128
+
+// The longest attribute name that may be provided.
+const MaxAttributeNameLength = 64
+
 // The Item itself.
+//
+// Seq is set by the Queue the Item is added to & orders the Items within it.
+//
+// Attributes hold metadata about the Item (such as a trace id or the
+// content-type of the Body), which is kept alongside the Body rather than in
+// it. It's nil if the Item has no attributes.
+//
+// Items with the same Group are handed out one at a time, in order, by the
+// Queue. An empty Group means the Item isn't in one.
 type Item struct {
 	Id               string
 	Body             string
@@ -23,6 +47,14 @@ type Item struct {
 	RemainingRetries int
 	Reserved         bool
 	Created          time.Time
+	ReservedAt       time.Time
+	Expires          time.Time
+	Owner            string
+	Receipt          string
+	Available        time.Time
+	Seq              uint64
+	Attributes       map[string]string
+	Group            string
 }
 
 // Decrements the number of times the Item can be retried.
@@ -47,30 +79,169 @@ func (i *Item) ShouldRetry() bool {
 
 // Returns if the Item is reserved.
 //
+// A reservation that has passed its expiry no longer counts as reserved.
+//
 // Returns true if reserved, false if not.
 func (i *Item) IsReserved() bool {
-	return i.Reserved
+	return i.Reserved && !i.IsExpired()
+}
+
+// Returns if the Item's reservation has expired.
+//
+// Items without an expiry (the zero time) never expire.
+//
+// Returns true if expired, false if not.
+func (i *Item) IsExpired() bool {
+	return !i.Expires.IsZero() && time.Now().After(i.Expires)
+}
+
+// Returns if the Item is delayed & can't be reserved yet.
+//
+// Returns true if delayed, false if it's available.
+func (i *Item) IsDelayed() bool {
+	return time.Now().Before(i.Available)
+}
+
+// Returns the state the Item is in.
+//
+// An Item whose reservation expired before it was finished with is "dead"
+// (its holder presumably died), though it may be reserved again like a
+// "ready" Item.
+//
+// Returns "reserved", "dead", "delayed" or "ready" (string).
+func (i *Item) State() string {
+	switch {
+	case i.IsReserved():
+		return "reserved"
+	case i.Reserved:
+		return "dead"
+	case i.IsDelayed():
+		return "delayed"
+	}
+
+	return "ready"
+}
+
+// Returns the size of the Item (in bytes), which is the length of the Body
+// plus the names & values of its Attributes.
+func (i *Item) Size() int {
+	size := len(i.Body)
+
+	for name, value := range i.Attributes {
+		size += len(name) + len(value)
+	}
+
+	return size
+}
+
+// Delays an Item from being reserved.
+//
+// Accepts how long (time.Duration) from now the Item should be held back. A
+// delay of zero (or less) makes it available immediately.
+func (i *Item) Delay(delay time.Duration) {
+	if delay <= 0 {
+		i.Available = time.Time{}
+		return
+	}
+
+	i.Available = time.Now().Add(delay)
 }
 
 // Marks an Item as reserved.
+//
+// A new Receipt is created for each reservation, so that holders of an older
+// reservation can be told apart from the current one.
 func (i *Item) Reserve() {
 	i.Reserved = true
+	i.Receipt = idgen.UUID4("")
+	i.ReservedAt = time.Now()
+	i.Expires = time.Time{}
+	i.Owner = ""
+}
+
+// Extends the reservation on an Item.
+//
+// Accepts how long (time.Duration) from now the reservation should last. A
+// timeout of zero (or less) means the reservation never expires.
+func (i *Item) Touch(timeout time.Duration) {
+	if timeout <= 0 {
+		i.Expires = time.Time{}
+		return
+	}
+
+	i.Expires = time.Now().Add(timeout)
 }
 
 // Releases the reserved status on an Item.
+//
+// The Receipt is kept, so that the previous holder can be recognized as stale.
 func (i *Item) Release() {
 	i.Reserved = false
+	i.Expires = time.Time{}
+	i.Owner = ""
+}
+
+// Returns if an Id (string) may be used for an Item.
+//
+// Ids must be between 1 & MaxIdLength bytes long & made up of printable,
+// non-space ASCII characters.
+func ValidId(id string) bool {
+	if len(id) == 0 || len(id) > MaxIdLength {
+		return false
+	}
+
+	return printable(id)
+}
+
+// Returns if a string is made up of printable, non-space ASCII characters.
+func printable(s string) bool {
+	for _, c := range []byte(s) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns if an attribute name & value (strings) may be used for an Item.
+//
+// Names must be between 1 & MaxAttributeNameLength bytes long & made up of
+// letters, digits, "-", "_" & ".". Values may be empty, but otherwise must be
+// made up of printable, non-space ASCII characters.
+func ValidAttribute(name string, value string) bool {
+	if len(name) == 0 || len(name) > MaxAttributeNameLength {
+		return false
+	}
+
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return printable(value)
 }
 
 // New creates a new Item instance.
 //
-// If an empty body is provided, this will return an EmptyBody error.
+// The Item is given a random (version 4) UUID as its Id. If an empty body is
+// provided, this will return an EmptyBody error.
 func New(body string, retries int) (*Item, error) {
 	if len(strings.TrimSpace(body)) <= 0 {
 		return &Item{}, EmptyBody
 	}
 
-	id := uuid.New()
+	id := idgen.UUID4("")
 	created := time.Now()
-	return &Item{id, body, retries, retries, false, created}, nil
+	return &Item{
+		Id:               id,
+		Body:             body,
+		InitialRetries:   retries,
+		RemainingRetries: retries,
+		Created:          created,
+	}, nil
 }
@@ -1,6 +1,7 @@
 package item_test
 
 import (
+	"strings"
 	"testing"
 	"github.com/toastdriven/takeanumber/item"
 )
@@ -40,6 +41,10 @@ func TestItem(t *testing.T) {
 		t.Error("Reserving failed")
 	}
 
+	if i.Receipt == "" {
+		t.Error("No receipt created on reserve")
+	}
+
 	i.Release()
 
 	if i.IsReserved() {
@@ -86,3 +91,35 @@ func TestItem(t *testing.T) {
 		t.Error("Decrementing below zero should fail")
 	}
 }
+
+func TestValidId(t *testing.T) {
+	if !item.ValidId("order-123") || !item.ValidId("42") {
+		t.Error("Valid Ids were rejected")
+	}
+
+	if item.ValidId("") || item.ValidId("has space") || item.ValidId("caf\u00e9") || item.ValidId(string(make([]byte, item.MaxIdLength+1))) {
+		t.Error("Invalid Ids were accepted")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	if !item.ValidAttribute("trace-id", "abc123") || !item.ValidAttribute("content.type", "application/json") || !item.ValidAttribute("empty", "") {
+		t.Error("Valid attributes were rejected")
+	}
+
+	if item.ValidAttribute("", "abc") || item.ValidAttribute("a=b", "c") || item.ValidAttribute("name", "has space") || item.ValidAttribute(strings.Repeat("a", item.MaxAttributeNameLength+1), "abc") {
+		t.Error("Invalid attributes were accepted")
+	}
+
+	i, _ := item.New("Hello", 0)
+
+	if i.Size() != 5 {
+		t.Error("Size should be the length of the body: ", i.Size())
+	}
+
+	i.Attributes = map[string]string{"tenant": "7", "trace": "abc"}
+
+	if i.Size() != 20 {
+		t.Error("Size should include the attributes: ", i.Size())
+	}
+}
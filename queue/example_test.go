@@ -24,10 +24,10 @@ func ExampleQueue() {
 	item, err := q.Reserve()
 	fmt.Println(item.Body)
 
-	// Mark it as Done.
-	success := q.Done(item.Id)
+	// Mark it as Done, using the receipt from the reservation.
+	err = q.Done(item.Id, item.Receipt)
 
-	if success {
+	if err == nil {
 		// Huzzah, time to celebrate!
 	}
 }
\ No newline at end of file
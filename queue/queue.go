@@ -8,16 +8,61 @@ package queue
 import (
 	"errors"
 	"github.com/toastdriven/takeanumber/item"
+	"sort"
 	"sync"
+	"time"
 )
 
 // An error for when there are no items in the queue.
 var EmptyQueue = errors.New("No items available to reserve.")
 
+// An error for when the requested Id is not in the queue.
+var NoSuchId = errors.New("No such Id.")
+
+// An error for when an item is not reserved.
+var NotReserved = errors.New("Item is not reserved.")
+
+// An error for when a receipt doesn't match the item's current reservation.
+var StaleReceipt = errors.New("Stale receipt.")
+
+// An error for when an item has used all of its retries.
+var NoRetries = errors.New("No retries remaining.")
+
+// An error for when an item can't be moved because it's reserved.
+var StillReserved = errors.New("Item is reserved.")
+
+// An error for when moving an item would split it from the rest of its group.
+var SplitGroup = errors.New("Item's group has other items in the queue.")
+
+// An error for when an item's Id is already in the queue.
+var DuplicateId = errors.New("Duplicate Id.")
+
+// An error for when items are moved from a queue to itself.
+var SameQueue = errors.New("Source & destination queues are the same.")
+
+// Held while moving items, so that moves between the same queues in opposite
+// directions can't deadlock.
+var moveLock = &sync.Mutex{}
+
+// The most Ids InsertWith tries while looking for one that isn't in use.
+const maxIdAttempts = 100
+
+// A deduplication key seen by Insert.
+type dedupKey struct {
+	key     string
+	id      string
+	expires time.Time
+}
+
 // The Queue itself.
 type Queue struct {
 	Items []*item.Item
 	lock *sync.Mutex
+	lastSeq uint64
+	paused bool
+	keys map[string]*dedupKey
+	keyOrder []*dedupKey
+	ids map[string]bool
 }
 
 // Adds an item to the end of the queue.
@@ -25,7 +70,7 @@ type Queue struct {
 // Accepts a body (string) & the number of times it can be retried (integer).
 // This will create a new Item & push it onto the end of the queue.
 //
-// The Item's Id (uuid string) is returned.
+// The Item's Id (string) is returned.
 func (q *Queue) Add(body string, retries int) (string, error) {
 	i, err := item.New(body, retries)
 
@@ -33,102 +78,693 @@ func (q *Queue) Add(body string, retries int) (string, error) {
 		return "", err
 	}
 
+	return q.Insert(i, "", 0)
+}
+
+// Inserts an Item at the end of the queue, unless it's a duplicate.
+//
+// Accepts the Item, a deduplication key (string) & how long (time.Duration)
+// the key is remembered for. If an item was inserted with the same key within
+// that window, the new Item is thrown away & the original item's Id is
+// returned instead (even if that item has since been finished with). An
+// empty key or a window of zero skips deduplication.
+//
+// Returns the Id (string) of the inserted (or original) item. If an item with
+// the same Id is already in the queue, a DuplicateId error is returned.
+func (q *Queue) Insert(i *item.Item, key string, window time.Duration) (string, error) {
+	return q.InsertWith(i, key, window, nil)
+}
+
+// Inserts an Item at the end of the queue, unless it's a duplicate, giving it
+// an Id made by next.
+//
+// This works like Insert, except that (if next isn't nil) the Item's Id is
+// replaced with the first one from next that isn't already in the queue.
+// Since that happens under the queue's lock & after the key is checked, Ids
+// aren't used up by duplicates & can't clash with Ids chosen by clients.
+//
+// Returns the Id (string) of the inserted (or original) item. If no unused Id
+// was found within maxIdAttempts, a DuplicateId error is returned.
+func (q *Queue) InsertWith(i *item.Item, key string, window time.Duration, next func() string) (string, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.Items = append(q.Items, i)
+	dedup := key != "" && window > 0
+	now := time.Now()
+
+	if dedup {
+		q.expireKeys(now)
+
+		if seen, ok := q.keys[key]; ok && now.Before(seen.expires) {
+			return seen.id, nil
+		}
+	}
+
+	if next != nil {
+		if err := q.nextId(i, next); err != nil {
+			return "", err
+		}
+	}
+
+	if err := q.pushUnique(i); err != nil {
+		return "", err
+	}
+
+	if !dedup {
+		return i.Id, nil
+	}
+
+	seen := &dedupKey{key, i.Id, now.Add(window)}
+	q.keys[key] = seen
+	q.keyOrder = append(q.keyOrder, seen)
 	return i.Id, nil
 }
 
+// Gives an Item the first Id from next that isn't already in the queue.
+//
+// The caller must hold the queue's lock.
+//
+// Returns a DuplicateId error if every Id tried was in use.
+func (q *Queue) nextId(i *item.Item, next func() string) error {
+	for n := 0; n < maxIdAttempts; n++ {
+		if id := next(); !q.ids[id] {
+			i.Id = id
+			return nil
+		}
+	}
+
+	return DuplicateId
+}
+
+// Forgets the deduplication keys whose window has passed.
+//
+// The caller must hold the queue's lock.
+func (q *Queue) expireKeys(now time.Time) {
+	expired := 0
+
+	for _, seen := range q.keyOrder {
+		if now.Before(seen.expires) {
+			break
+		}
+
+		// The key may have been seen again since.
+		if q.keys[seen.key] == seen {
+			delete(q.keys, seen.key)
+		}
+
+		expired++
+	}
+
+	q.keyOrder = q.keyOrder[expired:]
+}
+
 // Reserves an item from the front of the queue.
 //
-// This will fetch the first *non-reserved* Item from the queue, mark it as
-// reserved & return it. If all the items are already reserved or there is
-// nothing in the queue, an EmptyQueue error is returned.
+// This will fetch the first *non-reserved*, *non-delayed* Item from the
+// queue, mark it as reserved & return it. If all the items are already
+// reserved or there is nothing in the queue, an EmptyQueue error is returned.
+//
+// The reservation never expires. See ReserveFor for an expiring reservation.
 func (q *Queue) Reserve() (*item.Item, error) {
-	var i *item.Item
-	found := false
+	return q.ReserveFor("", 0)
+}
 
+// Reserves an item from the front of the queue on behalf of an owner.
+//
+// Accepts the owner (string) taking the reservation & how long
+// (time.Duration) the reservation lasts. A timeout of zero means the
+// reservation never expires. Items whose reservation has expired are treated
+// as unreserved & may be handed out again.
+//
+// Each reservation is given a new Receipt, which must be provided to Touch,
+// Done & Retry the item.
+//
+// Items in the same group are handed out one at a time, in the order they
+// were added (see available).
+//
+// If all the items are already reserved, there is nothing in the queue or
+// the queue is paused, an EmptyQueue error is returned.
+func (q *Queue) ReserveFor(owner string, timeout time.Duration) (*item.Item, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	for _, current := range q.Items {
-		if !current.IsReserved() {
-			i = current
-			found = true
-			break
-		}
+	if q.paused {
+		return &item.Item{}, EmptyQueue
 	}
 
-	if !found {
+	items := q.available(1)
+
+	if len(items) == 0 {
 		return &item.Item{}, EmptyQueue
 	}
 
+	i := items[0]
+
 	i.Reserve()
+	i.Owner = owner
+	i.Touch(timeout)
 	return i, nil
 }
 
+// Finds an item & checks the receipt for its reservation.
+//
+// The caller must hold the queue's lock.
+//
+// Returns the offset (integer) & the Item if the receipt is valid. If the
+// item isn't in the queue, a NoSuchId error is returned. If the item has never
+// been reserved, a NotReserved error is returned. If the receipt doesn't match
+// the current reservation (or the reservation has expired), a StaleReceipt
+// error is returned.
+func (q *Queue) checkReceipt(id string, receipt string) (int, *item.Item, error) {
+	for offset, current := range q.Items {
+		if current.Id != id {
+			continue
+		}
+
+		if current.Receipt == "" {
+			return offset, current, NotReserved
+		}
+
+		if current.Receipt != receipt || !current.IsReserved() {
+			return offset, current, StaleReceipt
+		}
+
+		return offset, current, nil
+	}
+
+	return -1, nil, NoSuchId
+}
+
+// Returns if a receipt (string) is for the current reservation of an item
+// (by Id, string). Reservations that have expired don't count.
+func (q *Queue) Holds(id string, receipt string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, _, err := q.checkReceipt(id, receipt)
+	return err == nil
+}
+
+// Extends the reservation on an item.
+//
+// Accepts the Id (string) of the item, the receipt (string) handed out when
+// it was reserved & the new timeout (time.Duration) measured from now. A
+// timeout of zero means the reservation never expires.
+//
+// Returns a NoSuchId, NotReserved or StaleReceipt error if the reservation
+// can't be extended.
+func (q *Queue) Touch(id string, receipt string, timeout time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, i, err := q.checkReceipt(id, receipt)
+
+	if err != nil {
+		return err
+	}
+
+	i.Touch(timeout)
+	return nil
+}
+
 // Marks an item as completed.
 //
-// Accepts the Id (string) of the item to be marked done.
-// If found, it will be removed from the queue.
+// Accepts the Id (string) of the item to be marked done & the receipt
+// (string) handed out when it was reserved. If the receipt is valid, the item
+// will be removed from the queue.
 //
-// Returns whether the item was successfully removed or not (bool).
-func (q *Queue) Done(id string) bool {
+// Returns a NoSuchId, NotReserved or StaleReceipt error if the item couldn't
+// be removed.
+func (q *Queue) Done(id string, receipt string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	for offset, current := range q.Items {
-		if current.Id == id {
-			q.Items = append(q.Items[:offset], q.Items[offset+1:]...)
-			return true
-		}
+	offset, _, err := q.checkReceipt(id, receipt)
+
+	if err != nil {
+		return err
 	}
 
-	return false
+	q.removeAt(offset)
+	return nil
 }
 
 // Marks an item to be retried.
 //
-// Accepts the Id (string) of the item to be retried. The item will become
-// unreserved, its retry count will be decremented & it maintain its place
-// early in the queue to be picked up again.
+// Accepts the Id (string) of the item to be retried & the receipt (string)
+// handed out when it was reserved. The item will become unreserved, its retry
+// count will be decremented & it maintain its place early in the queue to be
+// picked up again.
+//
+// If the retry count is zero, the item will be removed & a NoRetries error is
+// returned, since the item will disappear from the queue.
+//
+// Returns a NoSuchId, NotReserved or StaleReceipt error if the receipt isn't
+// valid.
+func (q *Queue) Retry(id string, receipt string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	offset, current, err := q.checkReceipt(id, receipt)
+
+	if err != nil {
+		return err
+	}
+
+	success := current.DecrRetries()
+
+	if !success {
+		q.removeAt(offset)
+		return NoRetries
+	}
+
+	current.Release()
+	return nil
+}
+
+// Releases the reservation on an item.
+//
+// Accepts the Id (string) of the item to be released, the receipt (string)
+// handed out when it was reserved & how long (time.Duration) to wait before it
+// can be reserved again. Unlike Retry, the item's retry count is left
+// untouched. The item maintains its place early in the queue to be picked up
+// again once the delay has passed.
+//
+// Returns a NoSuchId, NotReserved or StaleReceipt error if the receipt isn't
+// valid.
+func (q *Queue) Release(id string, receipt string, delay time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	_, current, err := q.checkReceipt(id, receipt)
+
+	if err != nil {
+		return err
+	}
+
+	current.Release()
+	current.Delay(delay)
+	return nil
+}
+
+// Returns the next items that would be reserved, *without* reserving them.
+//
+// Accepts the most items (integer) to return. Items that are reserved,
+// delayed or held back by their group are skipped, as Reserve would.
+//
+// Returns copies of the items, so that they can be looked at safely.
+func (q *Queue) Peek(count int) []item.Item {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := []item.Item{}
+
+	if count <= 0 {
+		return items
+	}
+
+	for _, current := range q.available(count) {
+		items = append(items, *current)
+	}
+
+	return items
+}
+
+// Finds the items that may be reserved, in the order they'd be handed out.
+//
+// Items that are reserved or delayed are skipped. Within a group, only the
+// first item may be reserved & only while no other item in the group is
+// reserved or delayed, so that each group is worked through one item at a
+// time, in order. Items without a group are never held back.
+//
+// Accepts the most items (integer) to find.
+//
+// The caller must hold the queue's lock.
+func (q *Queue) available(max int) []*item.Item {
+	items := []*item.Item{}
+	blocked := map[string]bool{}
+
+	for _, current := range q.Items {
+		if len(items) >= max {
+			break
+		}
+
+		if current.Group != "" {
+			if blocked[current.Group] {
+				continue
+			}
+
+			blocked[current.Group] = true
+		}
+
+		if !current.IsReserved() && !current.IsDelayed() {
+			items = append(items, current)
+		}
+	}
+
+	return items
+}
+
+// Looks up an item by Id, whatever state it's in.
+//
+// Accepts the Id (string) of the item.
 //
-// If the retry count is zero, the item will be removed & this will return
-// false, since the item will disappear from the queue.
+// Returns a copy of the item, or a NoSuchId error if it isn't in the queue.
+func (q *Queue) Inspect(id string) (item.Item, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, current := range q.Items {
+		if current.Id == id {
+			return *current, nil
+		}
+	}
+
+	return item.Item{}, NoSuchId
+}
+
+// Removes an item, whatever state it's in.
 //
-// Returns whether the item was successfully marked to be retried (bool).
-func (q *Queue) Retry(id string) bool {
+// Accepts the Id (string) of the item. Unlike Done, no receipt is needed, so
+// this should be kept for operators cleaning up a queue.
+//
+// Returns a NoSuchId error if the item isn't in the queue.
+func (q *Queue) Remove(id string) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
 	for offset, current := range q.Items {
 		if current.Id == id {
-			success := current.DecrRetries()
+			q.removeAt(offset)
+			return nil
+		}
+	}
+
+	return NoSuchId
+}
+
+// Locks the queue & another, for moving items from the queue to dst.
+//
+// Returns a function that unlocks them both.
+func (q *Queue) lockWith(dst *Queue) func() {
+	moveLock.Lock()
+	q.lock.Lock()
+	dst.lock.Lock()
+
+	return func() {
+		dst.lock.Unlock()
+		q.lock.Unlock()
+		moveLock.Unlock()
+	}
+}
 
-			if !success {
-				q.Items = append(q.Items[:offset], q.Items[offset+1:]...)
-				return false
+// Pushes an item onto the end of the queue, giving it the next Seq.
+//
+// The caller must hold the queue's lock.
+func (q *Queue) push(i *item.Item) {
+	q.lastSeq++
+	i.Seq = q.lastSeq
+	q.Items = append(q.Items, i)
+	q.ids[i.Id] = true
+}
+
+// Pushes an item onto the end of the queue, unless its Id is already in the
+// queue.
+//
+// The caller must hold the queue's lock.
+//
+// Returns a DuplicateId error if the Id is already in the queue.
+func (q *Queue) pushUnique(i *item.Item) error {
+	if q.ids[i.Id] {
+		return DuplicateId
+	}
+
+	q.push(i)
+	return nil
+}
+
+// Removes the item at an offset from the queue.
+//
+// The caller must hold the queue's lock.
+func (q *Queue) removeAt(offset int) {
+	delete(q.ids, q.Items[offset].Id)
+	q.Items = append(q.Items[:offset], q.Items[offset+1:]...)
+}
+
+// Moves items from the front of the queue to the end of another.
+//
+// Accepts the queue (*Queue) to move them to & the most items (integer) to
+// move (zero or less moves them all). Reserved items & items whose Id is
+// already in the other queue are left where they are. The items keep their
+// Ids, bodies & retry counts. Both queues are locked for the whole move, so
+// nothing can see an item in both (or neither).
+//
+// The items in a group are moved all together or not at all (such as when one
+// of them is reserved, or they'd go over the count), so that a group is never
+// split between the queues, where two of its items could be reserved at once.
+//
+// Returns the number of items moved (integer), or a SameQueue error.
+func (q *Queue) MoveTo(dst *Queue, count int) (int, error) {
+	if q == dst {
+		return 0, SameQueue
+	}
+
+	defer q.lockWith(dst)()
+
+	sizes := map[string]int{}
+	held := map[string]bool{}
+
+	for _, current := range q.Items {
+		if current.Group == "" {
+			continue
+		}
+
+		sizes[current.Group]++
+
+		if current.IsReserved() || dst.ids[current.Id] {
+			held[current.Group] = true
+		}
+	}
+
+	// How many items will be moved, counting the rest of any group that's
+	// being moved.
+	committed := 0
+	moving := map[string]bool{}
+	kept := []*item.Item{}
+	moved := 0
+
+	for _, current := range q.Items {
+		group := current.Group
+
+		if group != "" && !moving[group] && !held[group] {
+			if count > 0 && committed+sizes[group] > count {
+				held[group] = true
+			} else {
+				moving[group] = true
+				committed += sizes[group]
+			}
+		}
+
+		switch {
+		case group != "" && held[group]:
+		case group == "" && (current.IsReserved() || (count > 0 && committed >= count)):
+		case dst.pushUnique(current) != nil:
+		default:
+			if group == "" {
+				committed++
 			}
 
-			current.Release()
-			return true
+			delete(q.ids, current.Id)
+			moved++
+			continue
 		}
+
+		kept = append(kept, current)
 	}
 
-	return false
+	q.Items = kept
+	return moved, nil
 }
 
-// Returns the length of *unreserved* items in the queue.
+// Moves a single item from the queue to the end of another.
+//
+// Accepts the queue (*Queue) to move it to & the Id (string) of the item. The
+// item keeps its Id, body & retry counts.
+//
+// Returns a NoSuchId error if the item isn't in the queue, a StillReserved
+// error if it's reserved, a SplitGroup error if other items in its group are
+// still in the queue (moving it alone would let it jump ahead of them), a
+// DuplicateId error if its Id is already in the other queue or a SameQueue
+// error.
+func (q *Queue) MoveIdTo(dst *Queue, id string) error {
+	if q == dst {
+		return SameQueue
+	}
+
+	defer q.lockWith(dst)()
+
+	for offset, current := range q.Items {
+		if current.Id != id {
+			continue
+		}
+
+		if current.IsReserved() {
+			return StillReserved
+		}
+
+		if q.groupSize(current.Group) > 1 {
+			return SplitGroup
+		}
+
+		if err := dst.pushUnique(current); err != nil {
+			return err
+		}
+
+		q.removeAt(offset)
+		return nil
+	}
+
+	return NoSuchId
+}
+
+// Returns the number of items (integer) in a group (string). Items without a
+// group (an empty string) are each counted as their own group of one.
+//
+// The caller must hold the queue's lock.
+func (q *Queue) groupSize(group string) int {
+	if group == "" {
+		return 1
+	}
+
+	size := 0
+
+	for _, current := range q.Items {
+		if current.Group == group {
+			size++
+		}
+	}
+
+	return size
+}
+
+// Removes every item matching a function from the queue.
+//
+// Accepts a function that picks which items to remove, such as Unreserved,
+// Reserved or All.
+//
+// Returns the number of items removed (integer).
+func (q *Queue) Purge(match func(i *item.Item) bool) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	kept := []*item.Item{}
+
+	for _, current := range q.Items {
+		if match(current) {
+			delete(q.ids, current.Id)
+		} else {
+			kept = append(kept, current)
+		}
+	}
+
+	purged := len(q.Items) - len(kept)
+	q.Items = kept
+	return purged
+}
+
+// Returns if an item isn't currently reserved (for use with Purge).
+func Unreserved(i *item.Item) bool {
+	return !i.IsReserved()
+}
+
+// Returns if an item is currently reserved (for use with Purge).
+func Reserved(i *item.Item) bool {
+	return i.IsReserved()
+}
+
+// Matches every item (for use with Purge).
+func All(i *item.Item) bool {
+	return true
+}
+
+// Scans through the items in the queue, a batch at a time.
+//
+// Accepts a cursor (uint64), the number of items (integer) to look at & a
+// function that picks which of those items to return. The first call should
+// use a cursor of zero; each call returns the cursor for the next. Once the
+// end of the queue is reached, the returned cursor is zero.
+//
+// The queue is only locked for each batch, so items may be added or removed
+// between calls. Items that stay in the queue for the whole scan are returned
+// exactly once.
+//
+// Returns copies of the matching items & the next cursor (uint64).
+func (q *Queue) Scan(cursor uint64, count int, match func(i *item.Item) bool) ([]item.Item, uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Items are always added to the end, so they're ordered by Seq.
+	start := sort.Search(len(q.Items), func(n int) bool {
+		return q.Items[n].Seq > cursor
+	})
+	items := []item.Item{}
+
+	for n := start; n < len(q.Items) && n < start+count; n++ {
+		current := q.Items[n]
+		cursor = current.Seq
+
+		if match(current) {
+			items = append(items, *current)
+		}
+	}
+
+	if start+count >= len(q.Items) {
+		cursor = 0
+	}
+
+	return items, cursor
+}
+
+// Pauses the queue.
+//
+// While paused, nothing can be reserved from the queue, but items can still
+// be added & reservations already handed out can be finished with.
+func (q *Queue) Pause() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.paused = true
+}
+
+// Resumes a paused queue, so that items can be reserved again.
+func (q *Queue) Resume() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.paused = false
+}
+
+// Returns if the queue is paused.
+func (q *Queue) IsPaused() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.paused
+}
+
+// Returns the length of *unreserved*, *non-delayed* items in the queue.
 //
 // This count can be used to determine if there are any items to be processed.
 //
 // Returns a count of items (integer).
 func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
 	length := 0
 
 	for _, current := range q.Items {
-		if !current.IsReserved() {
+		if !current.IsReserved() && !current.IsDelayed() {
 			length++
 		}
 	}
@@ -140,5 +776,10 @@ func (q *Queue) Len() int {
 func New() *Queue {
 	items := []*item.Item{}
 	lock := &sync.Mutex{}
-	return &Queue{items, lock}
+	return &Queue{
+		Items: items,
+		lock:  lock,
+		keys:  map[string]*dedupKey{},
+		ids:   map[string]bool{},
+	}
 }
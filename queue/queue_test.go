@@ -1,7 +1,10 @@
 package queue_test
 
 import (
+	"strconv"
 	"testing"
+	"time"
+	"github.com/toastdriven/takeanumber/item"
 	"github.com/toastdriven/takeanumber/queue"
 )
 
@@ -76,11 +79,11 @@ func TestQueue(t *testing.T) {
 		t.Error("Queue length is wrong, expected 1, got:", q.Len())
 	}
 
-	if !q.Done(reserve_2.Id) {
+	if q.Done(reserve_2.Id, reserve_2.Receipt) != nil {
 		t.Error("Failed to mark second item as done.")
 	}
 
-	if !q.Retry(reserve_1.Id) {
+	if q.Retry(reserve_1.Id, reserve_1.Receipt) != nil {
 		t.Error("Failed to retry first item first time.")
 	}
 
@@ -99,7 +102,7 @@ func TestQueue(t *testing.T) {
 		t.Error("Got the wrong item back first, saw:", reserve_1_again.Body)
 	}
 
-	if !q.Retry(reserve_1.Id) {
+	if q.Retry(reserve_1.Id, reserve_1_again.Receipt) != nil {
 		t.Error("Failed to retry first item third time.")
 	}
 
@@ -107,7 +110,17 @@ func TestQueue(t *testing.T) {
 		t.Error("Failed to decrement first item retries.")
 	}
 
-	if q.Retry(reserve_1.Id) {
+	if q.Retry(reserve_1.Id, reserve_1_again.Receipt) != queue.StaleReceipt {
+		t.Error("Retrying with a released receipt should fail.")
+	}
+
+	reserve_1_last, err := q.Reserve()
+
+	if reserve_1_last.Id != id_1 {
+		t.Error("Got the wrong item back first, saw:", reserve_1_last.Body)
+	}
+
+	if q.Retry(reserve_1.Id, reserve_1_last.Receipt) != queue.NoRetries {
 		t.Error("First item wasn't removed after exceeding retries.")
 	}
 
@@ -115,3 +128,547 @@ func TestQueue(t *testing.T) {
 		t.Error("Queue length is wrong, expected 1, got:", q.Len())
 	}
 }
+
+func TestQueueTouch(t *testing.T) {
+	q := queue.New()
+	id, _ := q.Add("test 1", 0)
+
+	if q.Touch(id, "", time.Minute) != queue.NotReserved {
+		t.Error("Touching an unreserved item should fail.")
+	}
+
+	if q.Touch("nope", "", time.Minute) != queue.NoSuchId {
+		t.Error("Touching a missing item should fail.")
+	}
+
+	reserved, err := q.ReserveFor("1", time.Millisecond)
+
+	if err != nil || reserved.Id != id {
+		t.Error("Failed to reserve item:", err)
+	}
+
+	receipt := reserved.Receipt
+
+	if q.Touch(id, "nope", time.Minute) != queue.StaleReceipt {
+		t.Error("Touching with the wrong receipt should fail.")
+	}
+
+	if err := q.Touch(id, receipt, time.Minute); err != nil {
+		t.Error("Failed to touch item:", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if q.Len() != 0 {
+		t.Error("Touched item should still be reserved.")
+	}
+
+	if err := q.Touch(id, receipt, time.Millisecond); err != nil {
+		t.Error("Failed to touch item:", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if q.Len() != 1 {
+		t.Error("Expired item should be available again.")
+	}
+
+	if q.Touch(id, receipt, time.Minute) != queue.StaleReceipt {
+		t.Error("Touching an expired reservation should fail.")
+	}
+
+	again, err := q.ReserveFor("2", 0)
+
+	if err != nil || again.Id != id {
+		t.Error("Failed to reserve expired item:", err)
+	}
+
+	if again.Receipt == receipt {
+		t.Error("Reserving again should issue a new receipt.")
+	}
+
+	if !q.Holds(id, again.Receipt) || q.Holds(id, receipt) {
+		t.Error("Only the new receipt should hold the item.")
+	}
+
+	if q.Done(id, receipt) != queue.StaleReceipt {
+		t.Error("Done with a stale receipt should fail.")
+	}
+
+	if err := q.Done(id, again.Receipt); err != nil {
+		t.Error("Failed to mark item as done:", err)
+	}
+}
+
+func TestQueueRelease(t *testing.T) {
+	q := queue.New()
+	id, _ := q.Add("test 1", 1)
+
+	if q.Release(id, "", 0) != queue.NotReserved {
+		t.Error("Releasing an unreserved item should fail.")
+	}
+
+	reserved, _ := q.Reserve()
+
+	if err := q.Release(id, reserved.Receipt, 0); err != nil {
+		t.Error("Failed to release item:", err)
+	}
+
+	if reserved.RemainingRetries != 1 {
+		t.Error("Releasing should not use a retry, saw:", reserved.RemainingRetries)
+	}
+
+	if q.Len() != 1 {
+		t.Error("Released item should be available again.")
+	}
+
+	if q.Release(id, reserved.Receipt, 0) != queue.StaleReceipt {
+		t.Error("Releasing twice should fail.")
+	}
+
+	reserved, _ = q.Reserve()
+
+	if err := q.Release(id, reserved.Receipt, 5*time.Millisecond); err != nil {
+		t.Error("Failed to release item:", err)
+	}
+
+	if q.Len() != 0 {
+		t.Error("Delayed item shouldn't be available yet.")
+	}
+
+	if _, err := q.Reserve(); err != queue.EmptyQueue {
+		t.Error("Delayed item shouldn't be reservable yet.")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if q.Len() != 1 {
+		t.Error("Delayed item should be available again.")
+	}
+}
+
+func TestQueuePeek(t *testing.T) {
+	q := queue.New()
+	id_1, _ := q.Add("test 1", 1)
+	id_2, _ := q.Add("test 2", 1)
+	q.Add("test 3", 1)
+
+	if peeked := q.Peek(2); len(peeked) != 2 || peeked[0].Id != id_1 || peeked[1].Id != id_2 {
+		t.Error("Peek returned the wrong items, saw:", peeked)
+	}
+
+	if q.Len() != 3 {
+		t.Error("Peek shouldn't reserve anything, saw:", q.Len())
+	}
+
+	q.Reserve()
+
+	if peeked := q.Peek(10); len(peeked) != 2 || peeked[0].Id != id_2 {
+		t.Error("Peek shouldn't include reserved items, saw:", peeked)
+	}
+
+	i, err := q.Inspect(id_1)
+
+	if err != nil || !i.Reserved || i.Body != "test 1" {
+		t.Error("Inspect returned the wrong item, saw:", i, err)
+	}
+
+	if _, err := q.Inspect("nope"); err != queue.NoSuchId {
+		t.Error("Inspecting a missing item should fail, saw:", err)
+	}
+}
+
+func TestQueueScan(t *testing.T) {
+	q := queue.New()
+	ids := []string{}
+
+	for n := 0; n < 5; n++ {
+		id, _ := q.Add("test", 1)
+		ids = append(ids, id)
+	}
+
+	all := func(i *item.Item) bool { return true }
+	items, cursor := q.Scan(0, 2, all)
+
+	if len(items) != 2 || items[0].Id != ids[0] || items[1].Id != ids[1] || cursor == 0 {
+		t.Error("First batch is wrong, saw:", items, cursor)
+	}
+
+	// Removing an item that's already been scanned doesn't skip any others.
+	reserved, _ := q.Reserve()
+	q.Done(reserved.Id, reserved.Receipt)
+	items, cursor = q.Scan(cursor, 2, all)
+
+	if len(items) != 2 || items[0].Id != ids[2] || items[1].Id != ids[3] || cursor == 0 {
+		t.Error("Second batch is wrong, saw:", items, cursor)
+	}
+
+	items, cursor = q.Scan(cursor, 2, all)
+
+	if len(items) != 1 || items[0].Id != ids[4] || cursor != 0 {
+		t.Error("Last batch is wrong, saw:", items, cursor)
+	}
+
+	reserved, _ = q.ReserveFor("", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	dead := func(i *item.Item) bool { return i.State() == "dead" }
+
+	if items, _ := q.Scan(0, 10, dead); len(items) != 1 || items[0].Id != reserved.Id {
+		t.Error("An expired reservation should be dead, saw:", items)
+	}
+}
+
+func TestQueuePurge(t *testing.T) {
+	q := queue.New()
+	id_1, _ := q.Add("test 1", 1)
+	q.Add("test 2", 1)
+	q.Add("test 3", 1)
+	q.Reserve()
+
+	if err := q.Remove("nope"); err != queue.NoSuchId {
+		t.Error("Removing a missing item should fail, saw:", err)
+	}
+
+	if purged := q.Purge(queue.Unreserved); purged != 2 {
+		t.Error("Expected 2 unreserved items purged, saw:", purged)
+	}
+
+	if len(q.Items) != 1 || q.Items[0].Id != id_1 {
+		t.Error("The reserved item should be left, saw:", q.Items)
+	}
+
+	if err := q.Remove(id_1); err != nil || len(q.Items) != 0 {
+		t.Error("Removing a reserved item failed, saw:", err)
+	}
+
+	q.Add("test 4", 1)
+
+	if purged := q.Purge(queue.All); purged != 1 || q.Len() != 0 {
+		t.Error("Expected 1 item purged, saw:", purged)
+	}
+}
+
+func TestQueuePause(t *testing.T) {
+	q := queue.New()
+	q.Add("test 1", 1)
+	q.Pause()
+
+	if !q.IsPaused() {
+		t.Error("Queue should be paused.")
+	}
+
+	if _, err := q.Reserve(); err != queue.EmptyQueue {
+		t.Error("A paused queue shouldn't hand out items, saw:", err)
+	}
+
+	if _, err := q.Add("test 2", 1); err != nil {
+		t.Error("A paused queue should still accept items, saw:", err)
+	}
+
+	q.Resume()
+
+	if i, err := q.Reserve(); err != nil || i.Body != "test 1" {
+		t.Error("A resumed queue should hand out items, saw:", err)
+	}
+}
+
+func TestQueueLenConcurrent(t *testing.T) {
+	q := queue.New()
+	done := make(chan bool)
+
+	// Run with -race to catch Len reading the items while they're added to.
+	go func() {
+		defer close(done)
+
+		for n := 0; n < 100; n++ {
+			q.Add("test", 1)
+		}
+	}()
+
+	for n := 0; n < 100; n++ {
+		q.Len()
+	}
+
+	<-done
+
+	if q.Len() != 100 {
+		t.Error("Queue should have 100 items, saw:", q.Len())
+	}
+}
+
+func TestQueueMove(t *testing.T) {
+	src := queue.New()
+	dst := queue.New()
+	id_1, _ := src.Add("test 1", 3)
+	id_2, _ := src.Add("test 2", 2)
+	id_3, _ := src.Add("test 3", 1)
+	src.Reserve()
+
+	if _, err := src.MoveTo(src, 1); err != queue.SameQueue {
+		t.Error("Moving to the same queue should fail, saw:", err)
+	}
+
+	if err := src.MoveIdTo(dst, id_1); err != queue.StillReserved {
+		t.Error("Moving a reserved item should fail, saw:", err)
+	}
+
+	if moved, err := src.MoveTo(dst, 1); err != nil || moved != 1 {
+		t.Error("Expected 1 item moved, saw:", moved, err)
+	}
+
+	if err := src.MoveIdTo(dst, id_3); err != nil {
+		t.Error("Moving by Id failed, saw:", err)
+	}
+
+	if err := src.MoveIdTo(dst, id_3); err != queue.NoSuchId {
+		t.Error("Moving a missing item should fail, saw:", err)
+	}
+
+	if len(src.Items) != 1 || src.Items[0].Id != id_1 {
+		t.Error("Only the reserved item should be left, saw:", src.Items)
+	}
+
+	i, err := dst.Reserve()
+
+	if err != nil || i.Id != id_2 || i.Body != "test 2" || i.RemainingRetries != 2 {
+		t.Error("The moved item should be intact, saw:", i, err)
+	}
+
+	// Moving everything back doesn't need a count.
+	if moved, _ := dst.MoveTo(src, 0); moved != 1 || src.Items[1].Id != id_3 {
+		t.Error("Expected the unreserved item moved back, saw:", moved)
+	}
+}
+
+func TestQueueInsert(t *testing.T) {
+	q := queue.New()
+	i, _ := item.New("test 1", 1)
+	id, err := q.Insert(i, "order-1", time.Minute)
+
+	if err != nil || id != i.Id {
+		t.Error("Insert failed, saw:", id, err)
+	}
+
+	dupe, _ := item.New("test 1", 1)
+
+	if id, _ := q.Insert(dupe, "order-1", time.Minute); id != i.Id || len(q.Items) != 1 {
+		t.Error("A duplicate should return the original Id, saw:", id)
+	}
+
+	// The key is remembered even once the item has been finished with.
+	reserved, _ := q.Reserve()
+	q.Done(reserved.Id, reserved.Receipt)
+
+	if id, _ := q.Insert(dupe, "order-1", time.Minute); id != i.Id || len(q.Items) != 0 {
+		t.Error("A duplicate of a finished item should return the original Id, saw:", id)
+	}
+
+	other, _ := item.New("test 2", 1)
+
+	if id, _ := q.Insert(other, "order-2", time.Nanosecond); id != other.Id {
+		t.Error("A new key should insert the item, saw:", id)
+	}
+
+	time.Sleep(time.Millisecond)
+	again, _ := item.New("test 2", 1)
+
+	if id, _ := q.Insert(again, "order-2", time.Minute); id != again.Id || len(q.Items) != 2 {
+		t.Error("An expired key should insert the item, saw:", id)
+	}
+}
+
+func TestQueueDuplicateId(t *testing.T) {
+	q := queue.New()
+	other := queue.New()
+	i, _ := item.New("test 1", 1)
+	i.Id = "order-1"
+	q.Insert(i, "", 0)
+
+	dupe, _ := item.New("test 2", 1)
+	dupe.Id = "order-1"
+
+	if _, err := q.Insert(dupe, "", 0); err != queue.DuplicateId {
+		t.Error("A duplicate Id should be rejected, saw:", err)
+	}
+
+	other.Insert(dupe, "", 0)
+
+	if err := q.MoveIdTo(other, "order-1"); err != queue.DuplicateId {
+		t.Error("Moving onto a duplicate Id should fail, saw:", err)
+	}
+
+	if moved, _ := q.MoveTo(other, 0); moved != 0 || len(q.Items) != 1 {
+		t.Error("Items with duplicate Ids should be left behind, saw:", moved)
+	}
+
+	// Once the item is gone, its Id can be used again.
+	q.Remove("order-1")
+
+	if _, err := q.Insert(dupe, "", 0); err != nil {
+		t.Error("A finished Id should be usable again, saw:", err)
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	q := queue.New()
+	add := func(body string, group string) string {
+		i, _ := item.New(body, 1)
+		i.Group = group
+		id, _ := q.Insert(i, "", 0)
+		return id
+	}
+
+	a_1 := add("a 1", "user-a")
+	a_2 := add("a 2", "user-a")
+	b_1 := add("b 1", "user-b")
+	loose := add("loose", "")
+	b_2 := add("b 2", "user-b")
+
+	if peeked := q.Peek(10); len(peeked) != 3 || peeked[0].Id != a_1 || peeked[1].Id != b_1 || peeked[2].Id != loose {
+		t.Error("Peek should only include the first item in each group, saw:", peeked)
+	}
+
+	first, _ := q.Reserve()
+	second, _ := q.Reserve()
+	third, _ := q.Reserve()
+
+	if first.Id != a_1 || second.Id != b_1 || third.Id != loose {
+		t.Error("Reserved the wrong items, saw:", first.Id, second.Id, third.Id)
+	}
+
+	if _, err := q.Reserve(); err != queue.EmptyQueue {
+		t.Error("Groups with an item in flight should be held back, saw:", err)
+	}
+
+	q.Done(second.Id, second.Receipt)
+
+	if next, _ := q.Reserve(); next.Id != b_2 {
+		t.Error("The group should move on once its item is done, saw:", next.Id)
+	}
+
+	q.Retry(first.Id, first.Receipt)
+
+	if next, _ := q.Reserve(); next.Id != a_1 {
+		t.Error("A retried item should stay first in its group, saw:", next.Id)
+	} else {
+		q.Release(next.Id, next.Receipt, time.Hour)
+	}
+
+	if _, err := q.Reserve(); err != queue.EmptyQueue {
+		t.Error("A delayed item should hold back its group, saw:", err)
+	}
+
+	if _, err := q.Inspect(a_2); err != nil {
+		t.Error("The rest of the group should still be queued, saw:", err)
+	}
+}
+
+func TestQueueInsertWith(t *testing.T) {
+	q := queue.New()
+	n := 0
+	next := func() string {
+		n++
+		return strconv.Itoa(n)
+	}
+
+	mine, _ := item.New("mine", 0)
+	mine.Id = "2"
+	q.Insert(mine, "", 0)
+
+	first, _ := item.New("first", 0)
+
+	if id, err := q.InsertWith(first, "order-1", time.Minute, next); err != nil || id != "1" {
+		t.Error("InsertWith should use the generated Id, saw:", id, err)
+	}
+
+	dupe, _ := item.New("dupe", 0)
+
+	if id, _ := q.InsertWith(dupe, "order-1", time.Minute, next); id != "1" || n != 1 {
+		t.Error("A duplicate shouldn't use up an Id, saw:", id, n)
+	}
+
+	second, _ := item.New("second", 0)
+
+	if id, err := q.InsertWith(second, "", 0, next); err != nil || id != "3" {
+		t.Error("InsertWith should skip Ids already in the queue, saw:", id, err)
+	}
+
+	stuck, _ := item.New("stuck", 0)
+
+	if _, err := q.InsertWith(stuck, "", 0, func() string { return "1" }); err != queue.DuplicateId {
+		t.Error("InsertWith should give up if every Id is in use, saw:", err)
+	}
+}
+
+func TestQueueMoveGroups(t *testing.T) {
+	q := queue.New()
+	dst := queue.New()
+	add := func(q *queue.Queue, body string, group string) string {
+		i, _ := item.New(body, 1)
+		i.Group = group
+		id, _ := q.Insert(i, "", 0)
+		return id
+	}
+
+	add(q, "a 1", "user-a")
+	a_2 := add(q, "a 2", "user-a")
+	b_1 := add(q, "b 1", "user-b")
+	add(q, "b 2", "user-b")
+	loose := add(q, "loose", "")
+
+	q.Reserve()
+
+	if moved, _ := q.MoveTo(dst, 0); moved != 3 {
+		t.Error("A group with a reserved item should stay put, saw:", moved)
+	}
+
+	if _, err := q.Inspect(a_2); err != nil {
+		t.Error("The rest of the reserved group should stay behind, saw:", err)
+	}
+
+	first, _ := dst.Reserve()
+	second, _ := dst.Reserve()
+
+	if first.Id != b_1 || second.Id != loose {
+		t.Error("Reserved the wrong items after the move, saw:", first.Id, second.Id)
+	}
+
+	if _, err := dst.Reserve(); err != queue.EmptyQueue {
+		t.Error("The moved group should still be held back, saw:", err)
+	}
+
+	if err := q.MoveIdTo(dst, a_2); err != queue.SplitGroup {
+		t.Error("Moving an item away from its reserved group should fail, saw:", err)
+	}
+
+	split := queue.New()
+	add(split, "d 1", "user-d")
+	d_2 := add(split, "d 2", "user-d")
+
+	if err := split.MoveIdTo(dst, d_2); err != queue.SplitGroup || split.Len() != 2 {
+		t.Error("Moving one item of a group should fail, saw:", err)
+	}
+
+	e_1 := add(split, "e 1", "user-e")
+
+	if err := split.MoveIdTo(dst, e_1); err != nil {
+		t.Error("A group with a single item should move by Id, saw:", err)
+	}
+
+	if _, err := dst.Inspect(e_1); err != nil {
+		t.Error("The single item should be in the other queue, saw:", err)
+	}
+
+	counted := queue.New()
+	add(counted, "c 1", "user-c")
+	add(counted, "c 2", "user-c")
+	add(counted, "loose", "")
+
+	if moved, _ := counted.MoveTo(dst, 1); moved != 1 || counted.Len() != 2 {
+		t.Error("A group that doesn't fit in the count should stay put, saw:", moved)
+	}
+
+	if moved, _ := counted.MoveTo(dst, 2); moved != 2 || counted.Len() != 0 {
+		t.Error("A group that fits in the count should move together, saw:", moved)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// An error for when a client sends a command before authenticating.
+var NoAuth = errors.New("NOAUTH Authentication required.")
+
+// An error for when a client provides the wrong credentials.
+var WrongPass = errors.New("WRONGPASS Invalid username or password.")
+
+// An error for when a user isn't permitted to run a command.
+var NoPerm = errors.New("NOPERM Not permitted to run this command on this queue.")
+
+// A Permission allows a set of commands on the queues matching a glob.
+type Permission struct {
+	Commands []string
+	Queues   string
+}
+
+// Returns if the Permission allows a command (in an ACL category) on a queue.
+//
+// A command of "*" allows every command & one of "@<category>" allows every
+// command in that category. The queue glob uses the syntax of path.Match
+// (e.g. "email.*").
+func (p *Permission) Allows(command string, category string, queue string) bool {
+	matched, _ := path.Match(p.Queues, queue)
+
+	if !matched {
+		return false
+	}
+
+	for _, allowed := range p.Commands {
+		if allowed == "*" || allowed == command || allowed == "@"+strings.ToUpper(category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParsePermission parses a permission of the form "<commands>:<queue glob>".
+//
+// The commands are comma-separated (e.g. "RESERVE,DONE,RETRY:email.*") & may
+// include ACL categories (e.g. "@read,ADD:email.*").
+func ParsePermission(raw string) (*Permission, error) {
+	bits := strings.SplitN(raw, ":", 2)
+
+	if len(bits) != 2 || bits[0] == "" || bits[1] == "" {
+		return nil, fmt.Errorf("Invalid permission %q.", raw)
+	}
+
+	if _, err := path.Match(bits[1], ""); err != nil {
+		return nil, fmt.Errorf("Invalid queue glob %q.", bits[1])
+	}
+
+	commands := strings.Split(strings.ToUpper(bits[0]), ",")
+	return &Permission{commands, bits[1]}, nil
+}
+
+// A User that can authenticate with the server.
+//
+// The Password is either the plain-text password or, if prefixed with
+// "sha256:", the hex-encoded SHA-256 hash of the password.
+//
+// If the User has no Permissions, every command is allowed on every queue.
+type User struct {
+	Name        string
+	Password    string
+	Permissions []*Permission
+}
+
+// Returns if the User may run a command (in an ACL category) on a queue.
+//
+// Returns true if any of the User's Permissions allow it (or the User has no
+// Permissions), false if not.
+func (u *User) Allowed(command string, category string, queue string) bool {
+	if len(u.Permissions) == 0 {
+		return true
+	}
+
+	for _, p := range u.Permissions {
+		if p.Allows(command, category, queue) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks a password against the User's.
+//
+// Returns true if the password matches, false if not.
+func (u *User) Check(password string) bool {
+	expected := u.Password
+
+	if strings.HasPrefix(expected, "sha256:") {
+		expected = strings.ToLower(strings.TrimPrefix(expected, "sha256:"))
+		sum := sha256.Sum256([]byte(password))
+		password = hex.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// LoadUsers reads the users that may authenticate from a file.
+//
+// Each line of the file holds a username, password & optionally the user's
+// permissions, separated by whitespace. Blank lines & lines starting with "#"
+// are ignored. For example:
+//
+//	# Anything, anywhere.
+//	admin sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	# Only ADD to the email queues.
+//	web hunter2 ADD:email.*
+//	# Only work on the email queues.
+//	worker s3cret RESERVE,TOUCH,RETRY,RELEASE,DONE:email.* LEN:*
+//	# Only look at queues.
+//	monitor hunter3 @read:*
+//
+// Returns the Users, keyed by name.
+func LoadUsers(filename string) (map[string]*User, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	users := map[string]*User{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		bits := strings.Fields(line)
+
+		if len(bits) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a username & password", filename, lineNo)
+		}
+
+		user := &User{bits[0], bits[1], nil}
+
+		for _, raw := range bits[2:] {
+			p, err := ParsePermission(raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+			}
+
+			user.Permissions = append(user.Permissions, p)
+		}
+
+		users[user.Name] = user
+	}
+
+	return users, scanner.Err()
+}
@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/toastdriven/takeanumber/server"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServerAuth(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte(fmt.Sprintf("# Users\nweb hunter2\n\nworker sha256:%s\n", hex.EncodeToString(sum[:]))), 0600)
+
+	users, err := server.LoadUsers(path)
+
+	if err != nil {
+		t.Fatal("Couldn't load users: ", err)
+	}
+
+	if len(users) != 2 {
+		t.Error("Expected 2 users, saw: ", len(users))
+	}
+
+	if !users["worker"].Check("s3cret") || users["worker"].Check("nope") {
+		t.Error("Hashed password check is wrong.")
+	}
+
+	os.WriteFile(path, []byte("web\n"), 0600)
+
+	if _, err := server.LoadUsers(path); err == nil {
+		t.Error("A user without a password should fail to load.")
+	}
+
+	s := server.New(0)
+	s.Password = "letmein"
+	s.Users = users
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.Handle(conn)
+
+	reader := bufio.NewReader(client)
+	send := func(command string) string {
+		fmt.Fprint(client, command+"\r\n")
+		resp, _ := reader.ReadString('\n')
+		return resp
+	}
+
+	if resp := send("LEN test_queue"); resp != "-ERR NOAUTH Authentication required.\r\n" {
+		t.Error("Unauthenticated command should be rejected, got: ", resp)
+	}
+
+	if resp := send("AUTH wrong"); resp != "-ERR WRONGPASS Invalid username or password.\r\n" {
+		t.Error("Wrong password should be rejected, got: ", resp)
+	}
+
+	if resp := send("AUTH worker hunter2"); resp != "-ERR WRONGPASS Invalid username or password.\r\n" {
+		t.Error("Another user's password should be rejected, got: ", resp)
+	}
+
+	if resp := send("LEN test_queue"); resp != "-ERR NOAUTH Authentication required.\r\n" {
+		t.Error("Failed AUTH shouldn't authenticate, got: ", resp)
+	}
+
+	if resp := send("AUTH worker s3cret"); resp != "+OK\r\n" {
+		t.Error("AUTH with a user failed, got: ", resp)
+	}
+
+	if resp := send("LEN test_queue"); resp != ":0\r\n" {
+		t.Error("Authenticated command failed, got: ", resp)
+	}
+
+	if resp := send("AUTH letmein"); resp != "+OK\r\n" {
+		t.Error("AUTH with the password failed, got: ", resp)
+	}
+}
+
+func TestServerPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte("web hunter2 ADD:email.*\nworker s3cret RESERVE,done:email.* LEN:*\nmover m0ver @read,@admin:*.tmp\n"), 0600)
+
+	users, err := server.LoadUsers(path)
+
+	if err != nil {
+		t.Fatal("Couldn't load users: ", err)
+	}
+
+	web := users["web"]
+
+	if !web.Allowed("ADD", "write", "email.welcome") || web.Allowed("ADD", "write", "sms") || web.Allowed("RESERVE", "write", "email.welcome") {
+		t.Error("Web permissions are wrong.")
+	}
+
+	worker := users["worker"]
+
+	if !worker.Allowed("DONE", "write", "email.welcome") || !worker.Allowed("LEN", "read", "sms") || worker.Allowed("ADD", "write", "email.welcome") {
+		t.Error("Worker permissions are wrong.")
+	}
+
+	for _, bad := range []string{"ADD", "ADD:", "ADD:[", ":email"} {
+		os.WriteFile(path, []byte("web hunter2 "+bad+"\n"), 0600)
+
+		if _, err := server.LoadUsers(path); err == nil {
+			t.Error("Invalid permission should fail to load: ", bad)
+		}
+	}
+
+	s := server.New(0)
+	s.Users = users
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.Handle(conn)
+
+	reader := bufio.NewReader(client)
+	send := func(command string) string {
+		fmt.Fprint(client, command+"\r\n")
+		resp, _ := reader.ReadString('\n')
+		return resp
+	}
+
+	send("AUTH web hunter2")
+
+	if resp := send("ADD email.welcome 0 Hello"); !strings.HasPrefix(resp, "+") {
+		t.Error("Permitted ADD failed, got: ", resp)
+	}
+
+	if resp := send("ADD sms 0 Hello"); resp != "-ERR NOPERM Not permitted to run this command on this queue.\r\n" {
+		t.Error("ADD to another queue should be rejected, got: ", resp)
+	}
+
+	if resp := send("RESERVE email.welcome"); resp != "-ERR NOPERM Not permitted to run this command on this queue.\r\n" {
+		t.Error("RESERVE should be rejected, got: ", resp)
+	}
+
+	// Tabs mustn't let the queue checked differ from the one used.
+	send("AUTH mover m0ver")
+
+	for _, command := range []string{"MOVE secret\tmine.tmp", "INSPECT secret\tmine.tmp", "REMOVE secret\tmine.tmp", "SCAN secret\t0"} {
+		if resp := send(command); resp != "-ERR NOPERM Not permitted to run this command on this queue.\r\n" {
+			t.Error("A tab-separated command should be checked against the right queue, got: ", command, resp)
+		}
+	}
+}
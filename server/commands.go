@@ -0,0 +1,257 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The ACL categories commands belong to.
+//
+// A permission may name a category (e.g. "@write:email.*") instead of
+// listing each command. Commands in the CategoryConnection category are
+// always permitted.
+const (
+	CategoryRead       = "read"
+	CategoryWrite      = "write"
+	CategoryAdmin      = "admin"
+	CategoryConnection = "connection"
+)
+
+// An error for when a client sends a command the server doesn't know.
+var UnknownCommand = errors.New("Unrecognized command.")
+
+// A CommandFunc handles a single command sent by a Session.
+//
+// Returns the formatted response (string) to send to the client.
+type CommandFunc func(s *Server, sess *Session, req *Request) string
+
+// A Request is a single command sent by a client, split into its words.
+//
+// Words are split on any run of whitespace, with the command's name
+// upper-cased. Line keeps the original text, for the commands (like ADD)
+// whose last parameter may contain spaces.
+type Request struct {
+	Line  string
+	Words []string
+}
+
+// Splits a line sent by a client into a Request.
+func NewRequest(line string) *Request {
+	words := strings.Fields(line)
+
+	if len(words) > 0 {
+		words[0] = strings.ToUpper(words[0])
+	}
+
+	return &Request{Line: line, Words: words}
+}
+
+// Returns the text of the line after its first n words, as it was sent.
+//
+// Only the single whitespace character separating it from the nth word is
+// dropped. Returns an empty string if the line has n or fewer words.
+func (r *Request) Tail(n int) string {
+	rest := r.Line
+
+	for i := 0; i < n; i++ {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+
+		if end < 0 {
+			return ""
+		}
+
+		rest = rest[end:]
+	}
+
+	_, size := utf8.DecodeRuneInString(rest)
+	return rest[size:]
+}
+
+// A Command the server understands.
+//
+// Arity is the number of space-separated words the command takes, including
+// its name. A positive Arity is an exact count, a negative Arity is a
+// minimum (so -2 means "at least 2"). Commands with Public set may be run
+// before the client has authenticated.
+type Command struct {
+	Name     string
+	Arity    int
+	Category string
+	Usage    string
+	Help     string
+	Public   bool
+	Handler  CommandFunc
+}
+
+// Checks that a command has the right number of words for its Arity.
+//
+// Returns an error if there are too few or too many.
+func (cmd *Command) CheckArity(args []string) error {
+	words := len(args)
+
+	if cmd.Arity > 0 && words > cmd.Arity {
+		return fmt.Errorf("Too many %s parameters.", cmd.Name)
+	}
+
+	if words < cmd.Arity || words < -cmd.Arity {
+		return fmt.Errorf("Missing %s parameters.", cmd.Name)
+	}
+
+	return nil
+}
+
+// DefaultCommands returns the commands a Server understands out of the box.
+func DefaultCommands() []*Command {
+	return []*Command{
+		{"AUTH", -2, CategoryConnection, "AUTH [<username>] <password>", "Authenticates the connection.", true, (*Server).HandleAuth},
+		{"CLOSE", 1, CategoryConnection, "CLOSE", "Closes the connection.", true, (*Server).HandleClose},
+		{"COMMAND", 1, CategoryConnection, "COMMAND", "Lists the commands the server understands.", false, (*Server).HandleCommand},
+		{"HELP", -1, CategoryConnection, "HELP [<command>]", "Describes a command.", false, (*Server).HandleHelp},
+		{"LEN", 2, CategoryRead, "LEN <queue_name>", "Returns the number of items ready in a queue.", false, (*Server).HandleLen},
+		{"PEEK", -2, CategoryRead, "PEEK <queue_name> [<count>]", "Returns the next items in a queue, without reserving them.", false, (*Server).HandlePeek},
+		{"INSPECT", 3, CategoryRead, "INSPECT <queue_name> <id>", "Returns the full state of an item.", false, (*Server).HandleInspect},
+		{"SCAN", -3, CategoryRead, "SCAN <queue_name> <cursor> [STATE <state>] [MINAGE <seconds>] [MAXAGE <seconds>] [COUNT <count>]", "Browses the items in a queue, a batch at a time.", false, (*Server).HandleScan},
+		{"ADD", -4, CategoryWrite, "ADD <queue_name> [KEY <key>] [ID <id>] [GROUP <group>] [ATTR <name>=<value> ...] <retries> <value>", "Adds an item to the end of a queue.", false, (*Server).HandleAdd},
+		{"RESERVE", -2, CategoryWrite, "RESERVE <queue_name> [<seconds>] [ATTRS]", "Reserves the next item in a queue.", false, (*Server).HandleReserve},
+		{"TOUCH", -4, CategoryWrite, "TOUCH <queue_name> <id> <receipt> [<seconds>]", "Extends a reservation.", false, (*Server).HandleTouch},
+		{"RETRY", 4, CategoryWrite, "RETRY <queue_name> <id> <receipt>", "Returns a reserved item to its queue, using a retry.", false, (*Server).HandleRetry},
+		{"RELEASE", -4, CategoryWrite, "RELEASE <queue_name> <id> <receipt> [<seconds>]", "Returns a reserved item to its queue, without using a retry.", false, (*Server).HandleRelease},
+		{"DONE", 4, CategoryWrite, "DONE <queue_name> <id> <receipt>", "Removes a reserved item from its queue.", false, (*Server).HandleDone},
+		{"PURGE", -2, CategoryAdmin, "PURGE <queue_name> [ready|reserved|all]", "Removes the items in a queue.", false, (*Server).HandlePurge},
+		{"REMOVE", 3, CategoryAdmin, "REMOVE <queue_name> <id>", "Removes an item, whatever state it's in.", false, (*Server).HandleRemove},
+		{"MOVE", -3, CategoryAdmin, "MOVE <src_queue> <dst_queue> [<count>|ID <id>]", "Moves items from one queue to another.", false, (*Server).HandleMove},
+		{"PAUSE", 2, CategoryAdmin, "PAUSE <queue_name>", "Stops items being reserved from a queue.", false, (*Server).HandlePause},
+		{"RESUME", 2, CategoryAdmin, "RESUME <queue_name>", "Lets items be reserved from a paused queue again.", false, (*Server).HandleResume},
+		{"QUEUES", 1, CategoryRead, "QUEUES", "Lists the queues, their lengths & whether they're paused.", false, (*Server).HandleQueues},
+		{"STATS", 1, CategoryAdmin, "STATS", "Returns the server's statistics.", false, (*Server).HandleStats},
+	}
+}
+
+// Registers a Command with the Server, replacing any Command of the same name.
+//
+// Commands should be registered before the server starts serving.
+func (s *Server) Register(cmd *Command) {
+	cmd.Name = strings.ToUpper(cmd.Name)
+	s.Commands[cmd.Name] = cmd
+}
+
+// Looks up the Command a line sent by a client is for.
+//
+// The command's name is matched case-insensitively.
+//
+// Returns the Command (or nil, if there's no such Command) & the Request.
+func (s *Server) lookup(line string) (*Command, *Request) {
+	req := NewRequest(line)
+
+	if len(req.Words) == 0 {
+		return nil, req
+	}
+
+	return s.Commands[req.Words[0]], req
+}
+
+// Dispatches a command sent by a Session to its Command's Handler.
+//
+// The Session must have authenticated (unless the Command is Public), the
+// command must match the Command's Arity & the Session's User must be
+// permitted to run it.
+//
+// Returns the formatted response (string).
+func (s *Server) Dispatch(sess *Session, line string) string {
+	cmd, req := s.lookup(line)
+
+	if cmd == nil {
+		return s.FormatResponse(UnknownCommand)
+	}
+
+	if !cmd.Public && !sess.Authenticated && s.RequiresAuth() {
+		return s.FormatResponse(NoAuth)
+	}
+
+	if err := cmd.CheckArity(req.Words); err != nil {
+		return s.FormatResponse(err)
+	}
+
+	if !s.Permitted(sess, req.Words) {
+		return s.FormatResponse(NoPerm)
+	}
+
+	return cmd.Handler(s, sess, req)
+}
+
+// Handles the CLOSE command.
+//
+// The Session is marked as closed & the connection is closed without a
+// response.
+//
+// Command Format:
+//
+//	CLOSE\r\n
+func (s *Server) HandleClose(sess *Session, req *Request) string {
+	sess.Closed = true
+	return ""
+}
+
+// Handles the COMMAND command.
+//
+// Returns a formatted string of the names of the commands the server
+// understands, in alphabetical order.
+//
+// Command Format:
+//
+//	COMMAND\r\n
+//
+// Response Format:
+//
+//	+<name> <name> ...\r\n
+func (s *Server) HandleCommand(sess *Session, req *Request) string {
+	names := []string{}
+
+	for name := range s.Commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return s.FormatResponse(strings.Join(names, " "))
+}
+
+// Handles the HELP command.
+//
+// The command may include the name of a command to describe. Without one,
+// this behaves like COMMAND.
+//
+// Returns a formatted string of the command's usage, ACL category &
+// description.
+//
+// Command Format:
+//
+//	HELP [<command>]\r\n
+//
+// Response Format:
+//
+//	+<usage> | @<category> | <description>\r\n
+func (s *Server) HandleHelp(sess *Session, req *Request) string {
+	bits := req.Words
+
+	if len(bits) == 1 {
+		return s.HandleCommand(sess, req)
+	}
+
+	cmd := s.Commands[strings.ToUpper(bits[1])]
+
+	if cmd == nil {
+		return s.FormatResponse(UnknownCommand)
+	}
+
+	resp := fmt.Sprintf("%s | @%s | %s", cmd.Usage, cmd.Category, cmd.Help)
+	return s.FormatResponse(resp)
+}
@@ -0,0 +1,122 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/toastdriven/takeanumber/server"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServerCommands(t *testing.T) {
+	s := server.New(0)
+	s.Register(&server.Command{
+		Name:     "ping",
+		Arity:    1,
+		Category: server.CategoryRead,
+		Usage:    "PING",
+		Help:     "Replies with PONG.",
+		Handler: func(s *server.Server, sess *server.Session, req *server.Request) string {
+			return s.FormatResponse("PONG")
+		},
+	})
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.Handle(conn)
+
+	reader := bufio.NewReader(client)
+	send := func(command string) string {
+		fmt.Fprint(client, command+"\r\n")
+		resp, _ := reader.ReadString('\n')
+		return resp
+	}
+
+	if resp := send("len test_queue"); resp != ":0\r\n" {
+		t.Error("Commands should be case-insensitive, got: ", resp)
+	}
+
+	if resp := send("LENGTH test_queue"); resp != "-ERR Unrecognized command.\r\n" {
+		t.Error("Unknown command should be rejected, got: ", resp)
+	}
+
+	if resp := send("CLOSEXYZ"); resp != "-ERR Unrecognized command.\r\n" {
+		t.Error("A command starting with CLOSE shouldn't close, got: ", resp)
+	}
+
+	if resp := send("LEN"); resp != "-ERR Missing LEN parameters.\r\n" {
+		t.Error("Too few parameters should be rejected, got: ", resp)
+	}
+
+	if resp := send("DONE test_queue 1 2 3"); resp != "-ERR Too many DONE parameters.\r\n" {
+		t.Error("Too many parameters should be rejected, got: ", resp)
+	}
+
+	if resp := send("Ping"); resp != "+PONG\r\n" {
+		t.Error("Registered command didn't run, got: ", resp)
+	}
+
+	resp := send("COMMAND")
+
+	if !strings.HasPrefix(resp, "+ADD AUTH CLOSE COMMAND DONE HELP ") || !strings.Contains(resp, " PING ") {
+		t.Error("COMMAND should list the commands, got: ", resp)
+	}
+
+	if resp := send("HELP add"); resp != "+ADD <queue_name> [KEY <key>] [ID <id>] [GROUP <group>] [ATTR <name>=<value> ...] <retries> <value> | @write | Adds an item to the end of a queue.\r\n" {
+		t.Error("HELP should describe the command, got: ", resp)
+	}
+
+	if resp := send("HELP nope"); resp != "-ERR Unrecognized command.\r\n" {
+		t.Error("HELP on an unknown command should fail, got: ", resp)
+	}
+
+	fmt.Fprint(client, "close\r\n")
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("CLOSE should close the connection.")
+	}
+}
+
+func TestServerCategories(t *testing.T) {
+	p, _ := server.ParsePermission("@read,ADD:email.*")
+	s := server.New(0)
+	s.Users = map[string]*server.User{
+		"monitor": {Name: "monitor", Password: "hunter2", Permissions: []*server.Permission{p}},
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.Handle(conn)
+
+	reader := bufio.NewReader(client)
+	send := func(command string) string {
+		fmt.Fprint(client, command+"\r\n")
+		resp, _ := reader.ReadString('\n')
+		return resp
+	}
+
+	if resp := send("HELP"); resp != "-ERR NOAUTH Authentication required.\r\n" {
+		t.Error("HELP should require authentication, got: ", resp)
+	}
+
+	if resp := send("auth monitor hunter2"); resp != "+OK\r\n" {
+		t.Error("AUTH failed, got: ", resp)
+	}
+
+	if resp := send("LEN email.welcome"); resp != ":0\r\n" {
+		t.Error("@read should allow LEN, got: ", resp)
+	}
+
+	if resp := send("ADD email.welcome 0 Hello"); !strings.HasPrefix(resp, "+") {
+		t.Error("ADD should be allowed, got: ", resp)
+	}
+
+	if resp := send("RESERVE email.welcome"); resp != "-ERR NOPERM Not permitted to run this command on this queue.\r\n" {
+		t.Error("RESERVE shouldn't be allowed, got: ", resp)
+	}
+
+	if resp := send("COMMAND"); !strings.HasPrefix(resp, "+ADD ") {
+		t.Error("Connection commands should always be allowed, got: ", resp)
+	}
+}
@@ -1,6 +1,11 @@
 package server_test
 
-import "github.com/toastdriven/takeanumber/server"
+import (
+    "context"
+    "net"
+    "github.com/toastdriven/takeanumber/server"
+    "time"
+)
 
 func ExampleServer() {
     port := 13331
@@ -8,6 +13,31 @@ func ExampleServer() {
     // Create a Server.
     s := server.New(port)
 
-    // Run the server.
-    s.Run()
+    // Stop the server after a while, letting clients finish up.
+    time.AfterFunc(time.Hour, func() {
+        s.Shutdown(context.Background())
+    })
+
+    // Run the server. This blocks until the server is shut down.
+    err := s.Run()
+
+    if err != server.ServerClosed {
+        // Bad things happened. Bail out.
+    }
+}
+
+func ExampleServer_Serve() {
+    // Create a Server, to be embedded in another program.
+    s := server.New(0)
+
+    // Bind to localhost only, on a port picked by the OS.
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+
+    if err != nil {
+        // Bad things happened. Bail out.
+    }
+
+    // Serve connections in the background.
+    go s.Serve(l)
+    defer s.Shutdown(context.Background())
 }
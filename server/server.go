@@ -3,7 +3,11 @@
 // license that can be found in the LICENSE file.
 
 /*
-Package server implements a TCP server that listens for queue commands.
+Package server implements a server that listens for queue commands over TCP
+(or a Unix domain socket).
+
+The server can also be embedded in another program, serving any
+net.Listener via Serve.
 
 For a complete description of the available commands, responses & errors, see
 the included Protocol.md document that is included with `takeanumber`.
@@ -12,19 +16,111 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/toastdriven/takeanumber/idgen"
+	"github.com/toastdriven/takeanumber/item"
 	"github.com/toastdriven/takeanumber/queue"
 )
 
+// An error returned by Run once the server has been shut down.
+var ServerClosed = errors.New("Server closed.")
+
+// An error sent to clients when the server is shutting down.
+var ShuttingDown = errors.New("Server shutting down.")
+
+// An error sent to clients turned away for exceeding a connection limit.
+var TooManyConnections = errors.New("Too many connections.")
+
+// An error sent to clients disconnected for being idle.
+var IdleTimeout = errors.New("Idle timeout.")
+
+// An error for when a command is longer than MaxCommandSize.
+var CommandTooLarge = errors.New("Command too large.")
+
+// An error for when an item's body is longer than MaxBodySize.
+var BodyTooLarge = errors.New("Body too large.")
+
+// The number of items SCAN looks at, unless told otherwise.
+const DefaultScanCount = 10
+
+// The longest body SCAN returns, before truncating it.
+const ScanBodyLength = 64
+
+// How long ADD remembers deduplication keys, unless told otherwise.
+const DefaultDedupWindow = 5 * time.Minute
+
+// The default limits on the size (in bytes) of commands & bodies.
+const (
+	DefaultMaxCommandSize = 1024 * 1024
+	DefaultMaxBodySize    = 512 * 1024
+)
+
 // The Server itself.
+//
+// The server listens on Host & Port over TCP. If Socket is set to a path, it
+// also listens on that Unix domain socket (with SocketMode permissions, if
+// set). If SocketOnly is set, it listens *only* on the Unix domain socket.
+//
+// If TLSConfig is set, clients must connect to the TCP port using TLS.
+//
+// If Password or Users are set, clients must AUTH before sending any other
+// commands.
+//
+// MaxConnections & MaxConnectionsPerIP limit how many clients may be
+// connected at once (zero means no limit). Clients that send nothing for
+// IdleTimeout are disconnected, as are clients that don't read a response
+// within WriteTimeout (zero means no timeout).
+//
+// The commands the server understands are looked up in Commands (see
+// Register).
+//
+// Commands longer than MaxCommandSize & bodies longer than MaxBodySize (in
+// bytes) are rejected, without disconnecting the client.
+//
+// ADD remembers deduplication keys for DedupWindow (zero disables
+// deduplication). If Ids is set, it creates the Ids for new items (rather
+// than random UUIDs).
 type Server struct {
+	Host string
 	Port int
+	Socket string
+	SocketMode os.FileMode
+	SocketOnly bool
+	TLSConfig *tls.Config
+	Password string
+	Users map[string]*User
 	Queues map[string]*queue.Queue
+	ReserveTimeout time.Duration
+	ReleaseOnClose bool
+	MaxConnections int
+	MaxConnectionsPerIP int
+	IdleTimeout time.Duration
+	WriteTimeout time.Duration
+	MaxCommandSize int
+	MaxBodySize int
+	DedupWindow time.Duration
+	Ids idgen.Generator
+	Stats *Stats
+	Commands map[string]*Command
+	lastSession uint64
+	lock *sync.Mutex
+	listeners map[net.Listener]bool
+	sessions map[*Session]bool
+	perIP map[string]int
+	active *sync.WaitGroup
+	closing bool
 }
 
 // Returns a string version of the port (with preceding colon) for use with
@@ -33,6 +129,99 @@ func (s *Server) NetPort() string {
 	return fmt.Sprintf(":%v", s.Port)
 }
 
+// Returns the "host:port" address the server listens on over TCP.
+//
+// An empty Host listens on all interfaces.
+func (s *Server) Address() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Opens a TCP listener on Address().
+//
+// If TLSConfig is set, connections to the listener use TLS.
+//
+// Returns the listener, or an error if it couldn't be opened.
+func (s *Server) ListenTCP() (net.Listener, error) {
+	if s.TLSConfig != nil {
+		return tls.Listen("tcp", s.Address(), s.TLSConfig)
+	}
+
+	return net.Listen("tcp", s.Address())
+}
+
+// Opens a Unix domain socket listener at Socket.
+//
+// A socket file left behind by a server that is no longer running is
+// removed first. If SocketMode is set, the socket file's permissions are
+// changed to it.
+//
+// Returns the listener, or an error if it couldn't be opened.
+func (s *Server) ListenSocket() (net.Listener, error) {
+	if fi, err := os.Lstat(s.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", s.Socket); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("Socket %s is already in use.", s.Socket)
+		}
+
+		os.Remove(s.Socket)
+	}
+
+	l, err := net.Listen("unix", s.Socket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.SocketMode != 0 {
+		if err := os.Chmod(s.Socket, s.SocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Opens the configured listeners.
+//
+// This listens over TCP (unless SocketOnly is set) & on the Unix domain
+// socket at Socket (if set).
+//
+// Returns the listeners, or an error if any of them couldn't be opened.
+func (s *Server) Listen() ([]net.Listener, error) {
+	listeners := []net.Listener{}
+
+	if s.SocketOnly && s.Socket == "" {
+		return nil, errors.New("No socket configured.")
+	}
+
+	if !s.SocketOnly {
+		l, err := s.ListenTCP()
+
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if s.Socket != "" {
+		l, err := s.ListenSocket()
+
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
 // Fetches & returns a Queue by name.
 //
 // Accepts the name (string) of the Queue. If the queue does not already exist,
@@ -40,6 +229,9 @@ func (s *Server) NetPort() string {
 //
 // Returns the Queue.
 func (s *Server) GetQueue(name string) *queue.Queue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if q, ok := s.Queues[name]; ok {
 		return q
 	}
@@ -50,14 +242,23 @@ func (s *Server) GetQueue(name string) *queue.Queue {
 
 // Formats a response for returning to the client.
 //
-// Accepts the response (interface{}), which may be a string, integer or error.
-// Based on the type of the response, this will create a RESP encoded string.
+// Accepts the response (interface{}), which may be a string, integer, error or
+// slice of strings. Based on the type of the response, this will create a RESP
+// encoded string. A slice of strings is encoded as an array of strings.
 //
 // Returns the formatted response (string).
 func (s *Server) FormatResponse(resp interface{}) string {
 	var toFormat string
 
-	switch resp.(type) {
+	switch resp := resp.(type) {
+	case []string:
+		formatted := fmt.Sprintf("*%d\r\n", len(resp))
+
+		for _, value := range resp {
+			formatted += s.FormatResponse(value)
+		}
+
+		return formatted
 	case string:
 		toFormat = "+%s\r\n"
 	case int, int8, int16, int32, int64:
@@ -71,6 +272,26 @@ func (s *Server) FormatResponse(resp interface{}) string {
 	return fmt.Sprintf(toFormat, resp)
 }
 
+// Parses a number of seconds for use as a reservation timeout.
+//
+// Accepts the raw seconds (string). If the value is missing (empty string),
+// the server's ReserveTimeout is used instead.
+//
+// Returns the timeout (time.Duration) or an error if the value is invalid.
+func (s *Server) ParseTimeout(seconds string) (time.Duration, error) {
+	if seconds == "" {
+		return s.ReserveTimeout, nil
+	}
+
+	secs, err := strconv.Atoi(seconds)
+
+	if err != nil || secs < 0 {
+		return 0, errors.New("Invalid number of seconds.")
+	}
+
+	return time.Duration(secs) * time.Second, nil
+}
+
 // Handles the LEN command.
 //
 // The command should include the name of the queue. The queue will be fetched
@@ -85,8 +306,8 @@ func (s *Server) FormatResponse(resp interface{}) string {
 // Response Format:
 //
 //	:<integer>\r\n
-func (s *Server) HandleLen(command string) string {
-	bits := strings.SplitN(command, " ", 2)
+func (s *Server) HandleLen(sess *Session, req *Request) string {
+	bits := req.Words
 
 	if len(bits) != 2 {
 		return s.FormatResponse(errors.New("Missing LEN parameters."))
@@ -96,12 +317,98 @@ func (s *Server) HandleLen(command string) string {
 	return s.FormatResponse(q.Len())
 }
 
+// The options ADD accepts between the queue name & the retries.
+type addOptions struct {
+	key   string
+	id    string
+	group string
+	attrs map[string]string
+}
+
+// Parses the options, retries & body of an ADD command (the words after the
+// queue name).
+//
+// Each option is a keyword followed by a value (e.g. "KEY order-123"). The
+// first number ends the options & is the number of retries. Everything after
+// it is the body, as-is. Since the retries have always had to be a number,
+// the body of an ADD without options is never mistaken for options.
+//
+// Returns the options, the retries (integer) & the body (string).
+func parseAdd(req *Request) (*addOptions, int, string, error) {
+	opts := &addOptions{}
+	bits := req.Words
+
+	for n := 2; n < len(bits); n += 2 {
+		if retries, err := strconv.Atoi(bits[n]); err == nil {
+			if len(bits) < n+2 {
+				return nil, 0, "", errors.New("Missing ADD parameters.")
+			}
+
+			return opts, retries, req.Tail(n + 1), nil
+		}
+
+		if len(bits) < n+3 {
+			return nil, 0, "", errors.New("Missing ADD parameters.")
+		}
+
+		value := bits[n+1]
+
+		switch strings.ToUpper(bits[n]) {
+		case "KEY":
+			opts.key = value
+		case "ID":
+			if !item.ValidId(value) {
+				return nil, 0, "", item.InvalidId
+			}
+
+			opts.id = value
+		case "GROUP":
+			// Groups follow the same rules as Ids.
+			if !item.ValidId(value) {
+				return nil, 0, "", item.InvalidGroup
+			}
+
+			opts.group = value
+		case "ATTR":
+			pair := strings.SplitN(value, "=", 2)
+
+			if len(pair) != 2 || !item.ValidAttribute(pair[0], pair[1]) {
+				return nil, 0, "", item.InvalidAttribute
+			}
+
+			if opts.attrs == nil {
+				opts.attrs = map[string]string{}
+			}
+
+			opts.attrs[pair[0]] = pair[1]
+		default:
+			return nil, 0, "", errors.New("Invalid number of retries.")
+		}
+	}
+
+	return nil, 0, "", errors.New("Missing ADD parameters.")
+}
+
 // Handles the ADD command.
 //
-// The command should include the name of the queue, the number of times it can
-// be retried & the message body. The queue will be fetched
+// The command should include the name of the queue, any options, the number
+// of times it can be retried & the message body. The queue will be fetched
 // & a new Item with the data will be placed at the end of the queue.
 //
+// The options come before the retries, so that bodies are always sent as-is.
+// They are:
+//
+//   - KEY <key>: A deduplication key. If an item was added to the queue with
+//     the same key within the server's DedupWindow, no new item is added &
+//     the original item's Id is returned instead.
+//   - ID <id>: The Id to give the item, instead of generating one (with the
+//     server's Ids generator). If an item with the same Id is already in the
+//     queue, a DuplicateId error is returned.
+//   - GROUP <group>: The group the item belongs to. Items in the same group
+//     are reserved one at a time, in the order they were added.
+//   - ATTR <name>=<value>: An attribute to attach to the item. May be given
+//     more than once. The attributes count towards the MaxBodySize.
+//
 // Warning: Bodies may *not* be empty, nor can there be any bare newlines in
 // the body.
 //
@@ -109,26 +416,52 @@ func (s *Server) HandleLen(command string) string {
 //
 // Command Format:
 //
-//	ADD <queue_name> <retries> <value>\r\n
+//	ADD <queue_name> [KEY <key>] [ID <id>] [GROUP <group>] [ATTR <name>=<value> ...] <retries> <value>\r\n
 //
 // Response Format:
 //
 //	+<id>\r\n
-func (s *Server) HandleAdd(command string) string {
-	bits := strings.SplitN(command, " ", 4)
+func (s *Server) HandleAdd(sess *Session, req *Request) string {
+	bits := req.Words
 
-	if len(bits) != 4 {
+	if len(bits) < 4 {
 		return s.FormatResponse(errors.New("Missing ADD parameters."))
 	}
 
+	opts, retries, body, err := parseAdd(req)
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
 	q := s.GetQueue(bits[1])
-	retries, err := strconv.Atoi(bits[2])
+	i, err := item.New(body, retries)
 
 	if err != nil {
-		return s.FormatResponse(errors.New("Invalid number of retries."))
+		return s.FormatResponse(err)
+	}
+
+	i.Group = opts.group
+	i.Attributes = opts.attrs
+
+	if s.MaxBodySize > 0 && i.Size() > s.MaxBodySize {
+		return s.FormatResponse(BodyTooLarge)
+	}
+
+	// Generated Ids are only drawn once the key has been checked, skipping
+	// any already in the queue.
+	var next func() string
+
+	switch {
+	case opts.id != "":
+		i.Id = opts.id
+	case s.Ids != nil:
+		next = func() string {
+			return s.Ids.Next(bits[1])
+		}
 	}
 
-	id, err := q.Add(bits[3], retries)
+	id, err := q.InsertWith(i, opts.key, s.DedupWindow, next)
 
 	if err != nil {
 		return s.FormatResponse(err)
@@ -139,63 +472,169 @@ func (s *Server) HandleAdd(command string) string {
 
 // Handles the RESERVE command.
 //
-// The command should include the name of the queue. The queue will be fetched
-// & an item will be reserved off the front of the queue.
+// The command should include the name of the queue & optionally the number of
+// seconds before the reservation expires. The queue will be fetched & an item
+// will be reserved off the front of the queue on behalf of the session.
 //
-// Returns a formatted string of the item Id & body.
+// If no seconds are provided, the server's ReserveTimeout is used. A timeout
+// of zero means the reservation never expires.
+//
+// Returns a formatted string of the item Id, the receipt for this reservation
+// & the body. The receipt must be provided to TOUCH, RETRY or DONE the item.
+//
+// If the command ends with ATTRS, a formatted array is returned instead. The
+// first string is the same as above, followed by one "name=value" string for
+// each of the item's attributes (sorted by name).
 //
 // Command Format:
 //
-//	RESERVE <queue_name>\r\n
+//	RESERVE <queue_name> [<seconds>] [ATTRS]\r\n
 //
 // Response Format:
 //
-//	+<id> <body>\r\n
-func (s *Server) HandleReserve(command string) string {
-	bits := strings.SplitN(command, " ", 2)
+//	+<id> <receipt> <body>\r\n
+//
+//	// ...or, with ATTRS...
+//	*<count>\r\n
+//	+<id> <receipt> <body>\r\n
+//	+<name>=<value>\r\n
+//	...
+func (s *Server) HandleReserve(sess *Session, req *Request) string {
+	bits := req.Words
 
-	if len(bits) != 2 {
+	if len(bits) < 2 {
 		return s.FormatResponse(errors.New("Missing RESERVE parameters."))
 	}
 
+	withAttrs := len(bits) > 2 && strings.ToUpper(bits[len(bits)-1]) == "ATTRS"
+
+	if withAttrs {
+		bits = bits[:len(bits)-1]
+	}
+
+	seconds := strings.Join(bits[2:], " ")
+
+	timeout, err := s.ParseTimeout(seconds)
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
 	q := s.GetQueue(bits[1])
-	i, err := q.Reserve()
+	i, err := q.ReserveFor(sess.Id, timeout)
 
 	if err != nil {
 		return s.FormatResponse(err)
 	}
 
-	resp := fmt.Sprintf("%s %s", i.Id, i.Body)
+	s.pruneSession(sess)
+	sess.Track(bits[1], i.Id, i.Receipt)
+
+	resp := fmt.Sprintf("%s %s %s", i.Id, i.Receipt, i.Body)
+
+	if withAttrs {
+		return s.FormatResponse(append([]string{resp}, formatAttributes(i.Attributes, "")...))
+	}
+
 	return s.FormatResponse(resp)
 }
 
+// Formats an item's attributes as "name=value" strings, sorted by name.
+//
+// Accepts the attributes (map[string]string) & a prefix (string) to put
+// before each name.
+//
+// Returns the formatted attributes ([]string).
+func formatAttributes(attributes map[string]string, prefix string) []string {
+	attrs := []string{}
+
+	for name, value := range attributes {
+		attrs = append(attrs, prefix+name+"="+value)
+	}
+
+	sort.Strings(attrs)
+	return attrs
+}
+
+// Handles the TOUCH command.
+//
+// The command should include the name of the queue, the Id of the item, the
+// receipt from RESERVE & optionally the number of seconds to extend the
+// reservation by. The receipt must match the item's current reservation.
+//
+// If no seconds are provided, the server's ReserveTimeout is used. A timeout
+// of zero means the reservation never expires.
+//
+// Returns a formatted "OK" string.
+//
+// Command Format:
+//
+//	TOUCH <queue_name> <id> <receipt> [<seconds>]\r\n
+//
+// Response Format:
+//
+//	+OK\r\n
+func (s *Server) HandleTouch(sess *Session, req *Request) string {
+	bits := req.Words
+
+	if len(bits) > 5 {
+		return s.FormatResponse(errors.New("Too many TOUCH parameters."))
+	}
+
+	if len(bits) < 4 {
+		return s.FormatResponse(errors.New("Missing TOUCH parameters."))
+	}
+
+	seconds := ""
+
+	if len(bits) == 5 {
+		seconds = bits[4]
+	}
+
+	timeout, err := s.ParseTimeout(seconds)
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
+	q := s.GetQueue(bits[1])
+	err = q.Touch(bits[2], bits[3], timeout)
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
+	return s.FormatResponse("OK")
+}
+
 // Handles the RETRY command.
 //
-// The command should include the name of the queue & the Id of the item to
-// retry. The queue will be fetched & the item will marked to be retried.
+// The command should include the name of the queue, the Id of the item to
+// retry & the receipt from RESERVE. The queue will be fetched & the item will
+// marked to be retried.
 //
 // Returns a formatted "OK" string.
 //
 // Command Format:
 //
-//	RETRY <queue_name> <id>\r\n
+//	RETRY <queue_name> <id> <receipt>\r\n
 //
 // Response Format:
 //
 //	+OK\r\n
-func (s *Server) HandleRetry(command string) string {
-	bits := strings.SplitN(command, " ", 3)
+func (s *Server) HandleRetry(sess *Session, req *Request) string {
+	bits := req.Words
 
-	if len(bits) != 3 {
+	if len(bits) != 4 {
 		return s.FormatResponse(errors.New("Missing RETRY parameters."))
 	}
 
 	q := s.GetQueue(bits[1])
-	id := bits[2]
-	res := q.Retry(id)
+	err := q.Retry(bits[2], bits[3])
+	sess.Forget(bits[3])
 
-	if !res {
-		return s.FormatResponse(errors.New("No retries remaining."))
+	if err != nil {
+		return s.FormatResponse(err)
 	}
 
 	return s.FormatResponse("OK")
@@ -203,98 +642,1034 @@ func (s *Server) HandleRetry(command string) string {
 
 // Handles the DONE command.
 //
-// The command should include the name of the queue & the Id of the item to
-// be marked as done. The queue will be fetched & the item will be removed.
+// The command should include the name of the queue, the Id of the item to
+// be marked as done & the receipt from RESERVE. The queue will be fetched &
+// the item will be removed.
 //
 // Returns a formatted "OK" string.
 //
 // Command Format:
 //
-//	DONE <queue_name> <id>\r\n
+//	DONE <queue_name> <id> <receipt>\r\n
 //
 // Response Format:
 //
 //	+OK\r\n
-func (s *Server) HandleDone(command string) string {
-	bits := strings.SplitN(command, " ", 3)
+func (s *Server) HandleDone(sess *Session, req *Request) string {
+	bits := req.Words
 
-	if len(bits) != 3 {
+	if len(bits) != 4 {
 		return s.FormatResponse(errors.New("Missing DONE parameters."))
 	}
 
 	q := s.GetQueue(bits[1])
-	id := bits[2]
-	res := q.Done(id)
+	err := q.Done(bits[2], bits[3])
+	sess.Forget(bits[3])
 
-	if !res {
-		return s.FormatResponse(errors.New("No such Id."))
+	if err != nil {
+		return s.FormatResponse(err)
 	}
 
 	return s.FormatResponse("OK")
 }
 
-// Handles any command(s) sent by the client.
+// Handles the RELEASE command.
 //
-// The processing of each type of command is done by the other Handle*
-// functions on the Server instance. This simply handles the
-// reading/dispatching/writing flow.
-func (s *Server) Handle(c net.Conn) {
-	scanner := bufio.NewScanner(c)
+// The command should include the name of the queue, the Id of the item to
+// release, the receipt from RESERVE & optionally the number of seconds to
+// wait before the item can be reserved again. The item will become unreserved
+// *without* using one of its retries.
+//
+// Returns a formatted "OK" string.
+//
+// Command Format:
+//
+//	RELEASE <queue_name> <id> <receipt> [<seconds>]\r\n
+//
+// Response Format:
+//
+//	+OK\r\n
+func (s *Server) HandleRelease(sess *Session, req *Request) string {
+	bits := req.Words
 
-	for scanner.Scan() {
-		var resp string
-		command := strings.TrimSpace(scanner.Text())
+	if len(bits) > 5 {
+		return s.FormatResponse(errors.New("Too many RELEASE parameters."))
+	}
 
-		switch {
-		case strings.HasPrefix(command, "LEN "):
-			resp = s.HandleLen(command)
-		case strings.HasPrefix(command, "ADD "):
-			resp = s.HandleAdd(command)
-		case strings.HasPrefix(command, "RESERVE "):
-			resp = s.HandleReserve(command)
-		case strings.HasPrefix(command, "RETRY "):
-			resp = s.HandleRetry(command)
-		case strings.HasPrefix(command, "DONE "):
-			resp = s.HandleDone(command)
-		case strings.HasPrefix(command, "CLOSE"):
-			c.Close()
-			return
-		default:
-			resp = s.FormatResponse(errors.New("Unrecognized command."))
+	if len(bits) < 4 {
+		return s.FormatResponse(errors.New("Missing RELEASE parameters."))
+	}
+
+	delay := 0
+
+	if len(bits) == 5 {
+		secs, err := strconv.Atoi(bits[4])
+
+		if err != nil || secs < 0 {
+			return s.FormatResponse(errors.New("Invalid number of seconds."))
 		}
 
-		respBytes := []byte(resp)
-		c.Write(respBytes)
+		delay = secs
+	}
+
+	q := s.GetQueue(bits[1])
+	err := q.Release(bits[2], bits[3], time.Duration(delay)*time.Second)
+	sess.Forget(bits[3])
+
+	if err != nil {
+		return s.FormatResponse(err)
 	}
+
+	return s.FormatResponse("OK")
 }
 
-// Runs the server.
+// Handles the PEEK command.
+//
+// The command should include the name of the queue & optionally the most
+// items to return (1 by default). The next items that would be reserved are
+// returned, *without* reserving them.
+//
+// Returns a formatted array of strings, one for each item.
+//
+// Command Format:
+//
+//	PEEK <queue_name> [<count>]\r\n
+//
+// Response Format:
 //
-// This will use the preconfigured port, start listening on it & will spawn
-// goroutines for each connection made. This will run forever & must be
-// manually terminated.
-func (s *Server) Run() {
-	l, err := net.Listen("tcp", s.NetPort())
+//	*<count>\r\n
+//	+<id> <body>\r\n
+//	...
+func (s *Server) HandlePeek(sess *Session, req *Request) string {
+	bits := req.Words
 
-	if err != nil {
-		log.Fatal(err)
+	if len(bits) > 3 {
+		return s.FormatResponse(errors.New("Too many PEEK parameters."))
 	}
 
-	defer l.Close()
+	count := 1
 
-	for {
-		conn, err := l.Accept()
+	if len(bits) == 3 {
+		n, err := strconv.Atoi(bits[2])
 
-		if err != nil {
-			log.Fatal(err)
+		if err != nil || n < 1 {
+			return s.FormatResponse(errors.New("Invalid count."))
 		}
 
-		go s.Handle(conn)
+		count = n
+	}
+
+	q := s.GetQueue(bits[1])
+	resp := []string{}
+
+	for _, i := range q.Peek(count) {
+		resp = append(resp, fmt.Sprintf("%s %s", i.Id, i.Body))
 	}
+
+	return s.FormatResponse(resp)
 }
 
-// New creates a new Server instance.
-func New(port int) *Server {
-	qs := map[string]*queue.Queue{}
-	return &Server{port, qs}
+// Handles the INSPECT command.
+//
+// The command should include the name of the queue & the Id of the item. The
+// item is looked up whatever state it's in & left untouched.
+//
+// Returns a formatted string of the item's state, as space-separated
+// "name=value" pairs. Unset times & owners are shown as "-". The owner is the
+// Id of the session (connection) holding the reservation. Items that aren't
+// in a group show it as "-". Each of the item's
+// attributes follows as an "attr.<name>=<value>" pair (sorted by name). The
+// body is always last, since it may contain spaces.
+//
+// Command Format:
+//
+//	INSPECT <queue_name> <id>\r\n
+//
+// Response Format:
+//
+//	+id=<id> state=<state> reserved=<bool> ... body=<body>\r\n
+func (s *Server) HandleInspect(sess *Session, req *Request) string {
+	bits := req.Words
+	q := s.GetQueue(bits[1])
+	i, err := q.Inspect(bits[2])
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
+	owner := i.Owner
+
+	if owner == "" || !i.IsReserved() {
+		owner = "-"
+	}
+
+	group := i.Group
+
+	if group == "" {
+		group = "-"
+	}
+
+	attrs := ""
+
+	for _, attr := range formatAttributes(i.Attributes, "attr.") {
+		attrs += attr + " "
+	}
+
+	resp := fmt.Sprintf(
+		"id=%s state=%s reserved=%t initial_retries=%d remaining_retries=%d created=%s reserved_at=%s expires=%s available=%s owner=%s group=%s %sbody=%s",
+		i.Id,
+		i.State(),
+		i.IsReserved(),
+		i.InitialRetries,
+		i.RemainingRetries,
+		formatTime(i.Created),
+		formatTime(i.ReservedAt),
+		formatTime(i.Expires),
+		formatTime(i.Available),
+		owner,
+		group,
+		attrs,
+		i.Body,
+	)
+	return s.FormatResponse(resp)
+}
+
+// Handles the SCAN command.
+//
+// The command should include the name of the queue & a cursor (0 to start).
+// It may also include filters: the STATE items must be in ("ready",
+// "reserved", "delayed" or "dead"), the MINAGE & MAXAGE (in seconds, since
+// they were added) & how many items to look at (COUNT, 10 by default).
+//
+// The queue is only locked while each batch is looked at, so large queues can
+// be browsed without holding up other clients. Bodies longer than
+// ScanBodyLength are truncated (ending in "...").
+//
+// Returns a formatted array of strings. The first is the cursor to pass to
+// the next SCAN (or 0 once the end of the queue is reached), followed by one
+// for each matching item.
+//
+// Command Format:
+//
+//	SCAN <queue_name> <cursor> [STATE <state>] [MINAGE <seconds>] [MAXAGE <seconds>] [COUNT <count>]\r\n
+//
+// Response Format:
+//
+//	*<count>\r\n
+//	+<cursor>\r\n
+//	+<id> <state> <body>\r\n
+//	...
+func (s *Server) HandleScan(sess *Session, req *Request) string {
+	bits := req.Words
+	cursor, err := strconv.ParseUint(bits[2], 10, 64)
+
+	if err != nil {
+		return s.FormatResponse(errors.New("Invalid cursor."))
+	}
+
+	state := ""
+	count := DefaultScanCount
+	var minAge, maxAge time.Duration
+
+	if len(bits)%2 != 1 {
+		return s.FormatResponse(errors.New("Missing SCAN parameters."))
+	}
+
+	for n := 3; n < len(bits); n += 2 {
+		value := bits[n+1]
+
+		switch strings.ToUpper(bits[n]) {
+		case "STATE":
+			state = strings.ToLower(value)
+
+			if state != "ready" && state != "reserved" && state != "delayed" && state != "dead" {
+				return s.FormatResponse(errors.New("Invalid state."))
+			}
+		case "MINAGE", "MAXAGE":
+			age, err := s.ParseTimeout(value)
+
+			if err != nil {
+				return s.FormatResponse(err)
+			}
+
+			if strings.ToUpper(bits[n]) == "MINAGE" {
+				minAge = age
+			} else {
+				maxAge = age
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(value)
+
+			if err != nil || count < 1 {
+				return s.FormatResponse(errors.New("Invalid count."))
+			}
+		default:
+			return s.FormatResponse(fmt.Errorf("Unknown SCAN filter %s.", bits[n]))
+		}
+	}
+
+	now := time.Now()
+	match := func(i *item.Item) bool {
+		age := now.Sub(i.Created)
+		return (state == "" || i.State() == state) &&
+			age >= minAge &&
+			(maxAge == 0 || age <= maxAge)
+	}
+
+	q := s.GetQueue(bits[1])
+	items, next := q.Scan(cursor, count, match)
+	resp := []string{strconv.FormatUint(next, 10)}
+
+	for _, i := range items {
+		body := i.Body
+
+		if len(body) > ScanBodyLength {
+			body = body[:ScanBodyLength] + "..."
+		}
+
+		resp = append(resp, fmt.Sprintf("%s %s %s", i.Id, i.State(), body))
+	}
+
+	return s.FormatResponse(resp)
+}
+
+// Formats a time for a response, as RFC 3339 (or "-" for the zero time).
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Handles the PURGE command.
+//
+// The command should include the name of the queue & optionally which items
+// to remove: "ready" (any that aren't reserved), "reserved" or "all" (the
+// default). The count is added to the server's Stats.
+//
+// Returns a formatted integer of the number of items removed.
+//
+// Command Format:
+//
+//	PURGE <queue_name> [ready|reserved|all]\r\n
+//
+// Response Format:
+//
+//	:<integer>\r\n
+func (s *Server) HandlePurge(sess *Session, req *Request) string {
+	bits := req.Words
+
+	if len(bits) > 3 {
+		return s.FormatResponse(errors.New("Too many PURGE parameters."))
+	}
+
+	match := queue.All
+
+	if len(bits) == 3 {
+		switch strings.ToLower(bits[2]) {
+		case "ready":
+			match = queue.Unreserved
+		case "reserved":
+			match = queue.Reserved
+		case "all":
+		default:
+			return s.FormatResponse(errors.New("Invalid state."))
+		}
+	}
+
+	q := s.GetQueue(bits[1])
+	purged := q.Purge(match)
+	atomic.AddUint64(&s.Stats.Purged, uint64(purged))
+	return s.FormatResponse(purged)
+}
+
+// Handles the REMOVE command.
+//
+// The command should include the name of the queue & the Id of the item. The
+// item is removed whatever state it's in, without needing a receipt. The
+// removal is added to the server's Stats.
+//
+// Returns a formatted integer of the number of items removed.
+//
+// Command Format:
+//
+//	REMOVE <queue_name> <id>\r\n
+//
+// Response Format:
+//
+//	:1\r\n
+func (s *Server) HandleRemove(sess *Session, req *Request) string {
+	bits := req.Words
+	q := s.GetQueue(bits[1])
+
+	if err := q.Remove(bits[2]); err != nil {
+		return s.FormatResponse(err)
+	}
+
+	atomic.AddUint64(&s.Stats.Removed, 1)
+	return s.FormatResponse(1)
+}
+
+// Handles the MOVE command.
+//
+// The command should include the names of the source & destination queues &
+// optionally either the most items to move or "ID" & the Id of a single item.
+// Without either, every item is moved. Reserved items are never moved, nor are
+// items whose Id is already in the destination queue. The items in a group
+// are moved all together or not at all (see queue.MoveTo).
+//
+// The items keep their Ids, bodies & retry counts. The session must be
+// permitted to MOVE on both queues.
+//
+// Returns a formatted integer of the number of items moved.
+//
+// Command Format:
+//
+//	MOVE <src_queue> <dst_queue> [<count>|ID <id>]\r\n
+//
+// Response Format:
+//
+//	:<integer>\r\n
+func (s *Server) HandleMove(sess *Session, req *Request) string {
+	bits := req.Words
+
+	if !s.Permitted(sess, []string{"MOVE", bits[2]}) {
+		return s.FormatResponse(NoPerm)
+	}
+
+	src := s.GetQueue(bits[1])
+	dst := s.GetQueue(bits[2])
+
+	switch {
+	case len(bits) == 5 && strings.ToUpper(bits[3]) == "ID":
+		if err := src.MoveIdTo(dst, bits[4]); err != nil {
+			return s.FormatResponse(err)
+		}
+
+		return s.FormatResponse(1)
+	case len(bits) > 4:
+		return s.FormatResponse(errors.New("Too many MOVE parameters."))
+	}
+
+	count := 0
+
+	if len(bits) == 4 {
+		n, err := strconv.Atoi(bits[3])
+
+		if err != nil || n < 1 {
+			return s.FormatResponse(errors.New("Invalid count."))
+		}
+
+		count = n
+	}
+
+	moved, err := src.MoveTo(dst, count)
+
+	if err != nil {
+		return s.FormatResponse(err)
+	}
+
+	return s.FormatResponse(moved)
+}
+
+// Handles the PAUSE command.
+//
+// The command should include the name of the queue. Until it's resumed,
+// RESERVE on the queue acts as though it's empty, but items can still be
+// added & reservations already handed out can be finished with.
+//
+// Returns a formatted "OK" string.
+//
+// Command Format:
+//
+//	PAUSE <queue_name>\r\n
+//
+// Response Format:
+//
+//	+OK\r\n
+func (s *Server) HandlePause(sess *Session, req *Request) string {
+	bits := req.Words
+	s.GetQueue(bits[1]).Pause()
+	return s.FormatResponse("OK")
+}
+
+// Handles the RESUME command.
+//
+// The command should include the name of a paused queue, which will hand out
+// items from RESERVE again.
+//
+// Returns a formatted "OK" string.
+//
+// Command Format:
+//
+//	RESUME <queue_name>\r\n
+//
+// Response Format:
+//
+//	+OK\r\n
+func (s *Server) HandleResume(sess *Session, req *Request) string {
+	bits := req.Words
+	s.GetQueue(bits[1]).Resume()
+	return s.FormatResponse("OK")
+}
+
+// Returns the names of the server's queues, in alphabetical order.
+func (s *Server) queueNames() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := []string{}
+
+	for name := range s.Queues {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Handles the QUEUES command.
+//
+// Returns a formatted array of strings, one for each queue (in alphabetical
+// order), with its name, length & whether it's paused.
+//
+// Command Format:
+//
+//	QUEUES\r\n
+//
+// Response Format:
+//
+//	*<count>\r\n
+//	+<queue_name> len=<integer> paused=<bool>\r\n
+//	...
+func (s *Server) HandleQueues(sess *Session, req *Request) string {
+	resp := []string{}
+
+	for _, name := range s.queueNames() {
+		q := s.GetQueue(name)
+		resp = append(resp, fmt.Sprintf("%s len=%d paused=%t", name, q.Len(), q.IsPaused()))
+	}
+
+	return s.FormatResponse(resp)
+}
+
+// Handles the STATS command.
+//
+// Returns a formatted string of the server's statistics, as space-separated
+// "name=value" pairs.
+//
+// Command Format:
+//
+//	STATS\r\n
+//
+// Response Format:
+//
+//	+connections=<integer> queues=<integer> paused=<integer> accepted=<integer> ...\r\n
+func (s *Server) HandleStats(sess *Session, req *Request) string {
+	names := s.queueNames()
+	paused := 0
+
+	for _, name := range names {
+		if s.GetQueue(name).IsPaused() {
+			paused++
+		}
+	}
+
+	resp := fmt.Sprintf("connections=%d queues=%d paused=%d %s", s.Connections(), len(names), paused, s.Stats.Snapshot())
+	return s.FormatResponse(resp)
+}
+
+// Returns if clients must authenticate before sending commands.
+func (s *Server) RequiresAuth() bool {
+	return s.Password != "" || len(s.Users) > 0
+}
+
+// Returns if a Session may run a command.
+//
+// Sessions authenticated as a User are limited to that User's Permissions,
+// based on the command's name, its ACL category & the queue it names. Other
+// sessions may run any command, as may anyone for commands in the
+// CategoryConnection category.
+//
+// Accepts the words of the command (as split by strings.Fields), so that the
+// queue checked is the same one the command's handler sees.
+func (s *Server) Permitted(sess *Session, words []string) bool {
+	if sess.User == nil {
+		return true
+	}
+
+	if len(words) == 0 {
+		return false
+	}
+
+	cmd := s.Commands[words[0]]
+
+	if cmd == nil {
+		return false
+	}
+
+	if cmd.Category == CategoryConnection {
+		return true
+	}
+
+	queue := ""
+
+	if len(words) > 1 {
+		queue = words[1]
+	}
+
+	return sess.User.Allowed(cmd.Name, cmd.Category, queue)
+}
+
+// Handles the AUTH command.
+//
+// The command should include either a password (checked against the
+// server's Password) or a username & password (checked against the server's
+// Users). If they match, the session is authenticated.
+//
+// Returns a formatted "OK" string.
+//
+// Command Format:
+//
+//	AUTH <password>\r\n
+//	AUTH <username> <password>\r\n
+//
+// Response Format:
+//
+//	+OK\r\n
+func (s *Server) HandleAuth(sess *Session, req *Request) string {
+	bits := req.Words
+	var user *User
+
+	switch len(bits) {
+	case 2:
+		if s.Password == "" {
+			return s.FormatResponse(WrongPass)
+		}
+
+		user = &User{Name: "default", Password: s.Password}
+	case 3:
+		user = s.Users[bits[1]]
+
+		if user == nil {
+			return s.FormatResponse(WrongPass)
+		}
+	default:
+		return s.FormatResponse(errors.New("Missing AUTH parameters."))
+	}
+
+	if !user.Check(bits[len(bits)-1]) {
+		return s.FormatResponse(WrongPass)
+	}
+
+	sess.Authenticated = true
+	sess.User = nil
+
+	if len(bits) == 3 {
+		sess.User = user
+	}
+
+	return s.FormatResponse("OK")
+}
+
+// Stops tracking a Session's reservations that it no longer holds, because
+// they expired (& were perhaps finished by another client) or the item was
+// removed.
+//
+// Otherwise a long-lived connection would keep every receipt it was ever
+// handed that it didn't finish with itself.
+func (s *Server) pruneSession(sess *Session) {
+	for receipt, r := range sess.Reservations {
+		if !s.GetQueue(r.Queue).Holds(r.Id, receipt) {
+			sess.Forget(receipt)
+		}
+	}
+}
+
+// Releases any reservations still held by a Session.
+//
+// The items are returned to their queues without consuming a retry, so that
+// another client can pick them up. Reservations that have since expired or
+// been reserved by someone else are skipped.
+//
+// Returns the number of items released (integer).
+func (s *Server) ReleaseSession(sess *Session) int {
+	released := 0
+
+	for receipt, r := range sess.Reservations {
+		q := s.GetQueue(r.Queue)
+
+		if q.Release(r.Id, receipt, 0) == nil {
+			released++
+		}
+
+		sess.Forget(receipt)
+	}
+
+	return released
+}
+
+// Handles any command(s) sent by the client.
+//
+// The processing of each type of command is done by the Handler of its
+// Command (see Dispatch). This simply handles the reading/dispatching/writing
+// flow.
+//
+// When the client disconnects (or sends CLOSE), the connection is closed. If
+// ReleaseOnClose is set, any items it still has reserved are released.
+//
+// If the server is shutting down, the command in progress is allowed to
+// finish, then the client is sent a ShuttingDown error & disconnected.
+func (s *Server) Handle(c net.Conn) {
+	id := atomic.AddUint64(&s.lastSession, 1)
+	sess := NewSession(strconv.FormatUint(id, 10), c)
+	reader := bufio.NewReader(c)
+	var readErr error
+
+	if err := s.track(sess); err != nil {
+		s.write(c, s.FormatResponse(err))
+		c.Close()
+		return
+	}
+
+	defer func() {
+		if s.isClosing() {
+			s.write(c, s.FormatResponse(ShuttingDown))
+		} else if isTimeout(readErr) {
+			atomic.AddUint64(&s.Stats.TimedOut, 1)
+			s.write(c, s.FormatResponse(IdleTimeout))
+		}
+
+		if s.ReleaseOnClose {
+			s.ReleaseSession(sess)
+		}
+
+		s.untrack(sess)
+		c.Close()
+	}()
+
+	for {
+		if s.IdleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+
+		// Checked after setting the deadline, so that Shutdown can't be
+		// missed in between.
+		if s.isClosing() {
+			return
+		}
+
+		var line string
+		line, readErr = s.readCommand(reader)
+
+		if readErr != nil && readErr != CommandTooLarge {
+			return
+		}
+
+		var resp string
+
+		if readErr == CommandTooLarge {
+			resp = s.FormatResponse(CommandTooLarge)
+		} else {
+			resp = s.Dispatch(sess, strings.TrimSpace(line))
+		}
+
+		if sess.Closed {
+			return
+		}
+
+		if err := s.write(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// Reads a single command (up to a newline) from a connection.
+//
+// If the command is longer than MaxCommandSize, the rest of it is read &
+// thrown away, so that the client can carry on with its next command, & a
+// CommandTooLarge error is returned.
+//
+// Returns the command (string), or any error from reading.
+func (s *Server) readCommand(reader *bufio.Reader) (string, error) {
+	var line []byte
+	tooLarge := false
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+
+		if !tooLarge {
+			line = append(line, chunk...)
+		}
+
+		if s.MaxCommandSize > 0 && len(line) > s.MaxCommandSize+2 {
+			tooLarge = true
+			line = nil
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			// A final command without a trailing newline.
+			return string(line), nil
+		case err != nil:
+			return "", err
+		case tooLarge:
+			return "", CommandTooLarge
+		}
+
+		return string(line), nil
+	}
+}
+
+// Writes a response to a connection, within the WriteTimeout (if set).
+func (s *Server) write(c net.Conn, resp string) error {
+	if s.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+
+	_, err := c.Write([]byte(resp))
+	return err
+}
+
+// Returns if an error is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Returns the IP a connection was made from, or an empty string if it wasn't
+// made over TCP.
+func remoteIP(c net.Conn) string {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+
+	if !ok {
+		return ""
+	}
+
+	return addr.IP.String()
+}
+
+// Records a Session as connected, so that Shutdown can wait for it.
+//
+// Returns a ShuttingDown error if the server is shutting down, or a
+// TooManyConnections error if a connection limit has been reached. In either
+// case, the Session should be turned away.
+func (s *Server) track(sess *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		atomic.AddUint64(&s.Stats.Rejected, 1)
+		return ShuttingDown
+	}
+
+	ip := remoteIP(sess.Conn)
+
+	if s.MaxConnections > 0 && len(s.sessions) >= s.MaxConnections {
+		atomic.AddUint64(&s.Stats.Rejected, 1)
+		return TooManyConnections
+	}
+
+	if ip != "" && s.MaxConnectionsPerIP > 0 && s.perIP[ip] >= s.MaxConnectionsPerIP {
+		atomic.AddUint64(&s.Stats.Rejected, 1)
+		return TooManyConnections
+	}
+
+	if ip != "" {
+		s.perIP[ip]++
+	}
+
+	s.sessions[sess] = true
+	s.active.Add(1)
+	atomic.AddUint64(&s.Stats.Accepted, 1)
+	return nil
+}
+
+// Removes a Session once it has disconnected.
+func (s *Server) untrack(sess *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ip := remoteIP(sess.Conn); ip != "" {
+		s.perIP[ip]--
+
+		if s.perIP[ip] <= 0 {
+			delete(s.perIP, ip)
+		}
+	}
+
+	delete(s.sessions, sess)
+	s.active.Done()
+	atomic.AddUint64(&s.Stats.Closed, 1)
+}
+
+// Returns the number of clients currently connected.
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.sessions)
+}
+
+// Returns if the server is shutting down.
+func (s *Server) isClosing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closing
+}
+
+// Shuts the server down gracefully.
+//
+// The server stops accepting new connections. Each connected client is
+// allowed to finish the command it's running, then is sent a ShuttingDown
+// error & disconnected. Shutdown waits for all clients to disconnect.
+//
+// If ctx is done before then, the remaining connections are closed
+// immediately & ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closing = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	// Wake up any connection waiting on its next command.
+	for sess := range s.sessions {
+		sess.Conn.SetReadDeadline(time.Now())
+	}
+
+	s.lock.Unlock()
+
+	done := make(chan bool)
+
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+
+	for sess := range s.sessions {
+		sess.Conn.Close()
+	}
+
+	s.lock.Unlock()
+	return ctx.Err()
+}
+
+// Serves connections made to a listener.
+//
+// Accepts the listener (net.Listener) to serve, which lets the server be
+// bound to any address (or embedded in another program). A goroutine is
+// spawned for each connection made. Serve may be called with several
+// listeners at once.
+//
+// This will run until Shutdown is called, at which point the listener is
+// closed & a ServerClosed error is returned. Any other error from accepting
+// connections is returned as well.
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+
+	if s.closing {
+		s.lock.Unlock()
+		l.Close()
+		return ServerClosed
+	}
+
+	s.listeners[l] = true
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if s.isClosing() {
+				return ServerClosed
+			}
+
+			return err
+		}
+
+		go s.Handle(conn)
+	}
+}
+
+// Runs the server.
+//
+// This will open the configured listeners (see Listen) & serve them. This will
+// run until Shutdown is called, at which point a ServerClosed error is
+// returned. Any other error from listening or accepting connections is
+// returned as well, after closing the remaining listeners.
+func (s *Server) Run() error {
+	listeners, err := s.Listen()
+
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.Serve(l)
+		}(l)
+	}
+
+	err = <-errs
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	for n := 1; n < len(listeners); n++ {
+		<-errs
+	}
+
+	return err
+}
+
+// New creates a new Server instance.
+//
+// The Server understands the DefaultCommands.
+func New(port int) *Server {
+	qs := map[string]*queue.Queue{}
+	s := &Server{
+		Port:           port,
+		Queues:         qs,
+		MaxCommandSize: DefaultMaxCommandSize,
+		MaxBodySize:    DefaultMaxBodySize,
+		DedupWindow:    DefaultDedupWindow,
+		Stats:          &Stats{},
+		lock:           &sync.Mutex{},
+		listeners:      map[net.Listener]bool{},
+		sessions:       map[*Session]bool{},
+		perIP:          map[string]int{},
+		active:         &sync.WaitGroup{},
+		Commands:       map[string]*Command{},
+	}
+
+	for _, cmd := range DefaultCommands() {
+		s.Register(cmd)
+	}
+
+	return s
 }
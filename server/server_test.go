@@ -1,10 +1,17 @@
 package server_test
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+	"github.com/toastdriven/takeanumber/idgen"
 	"github.com/toastdriven/takeanumber/server"
 )
 
@@ -15,7 +22,17 @@ func TestServer(t *testing.T) {
 	port := s.NetPort()
 
 	if port != ":13331" {
-		t.Error("NetPort is wrong, saw: %v", port)
+		t.Errorf("NetPort is wrong, saw: %v", port)
+	}
+
+	if s.Address() != ":13331" {
+		t.Error("Address is wrong, saw: ", s.Address())
+	}
+
+	s.Host = "127.0.0.1"
+
+	if s.Address() != "127.0.0.1:13331" {
+		t.Error("Address is wrong, saw: ", s.Address())
 	}
 
 	// Queue shouldn't exist, but should spring to life.
@@ -53,44 +70,864 @@ func TestServer(t *testing.T) {
 	}
 
 	// LEN command
-	if s.HandleLen("LEN test_queue") != ":0\r\n" {
-		t.Error("Test queue already has items in it, got: ", s.HandleLen("LEN test_queue"))
+	sess := server.NewSession("1", nil)
+
+	if s.Dispatch(sess, "LEN test_queue") != ":0\r\n" {
+		t.Error("Test queue already has items in it, got: ", s.Dispatch(sess, "LEN test_queue"))
 	}
 
 	// ADD command
-	id := s.HandleAdd("ADD test_queue 3 Hello")
+	id := s.Dispatch(sess, "ADD test_queue 3 Hello")
 
 	if !strings.HasPrefix(id, "+") {
 		t.Error("Add didn't work, got: ", id)
 	}
 
-	new_len := s.HandleLen("LEN test_queue")
+	new_len := s.Dispatch(sess, "LEN test_queue")
 
 	if new_len != ":1\r\n" {
 		t.Error("Length is wrong, got: ", new_len)
 	}
 
 	// RESERVE command
-	resp := s.HandleReserve("RESERVE test_queue")
-	bits := strings.SplitN(resp, " ", 2)
+	resp := s.Dispatch(sess, "RESERVE test_queue")
+	bits := strings.SplitN(resp, " ", 3)
 	id = strings.TrimPrefix(bits[0], "+")
-	body := bits[1]
+	receipt := bits[1]
+	body := bits[2]
 
 	if body != "Hello\r\n" {
 		t.Error("Incorrect body returned, got: ", body)
 	}
 
+	// TOUCH command
+	resp = s.Dispatch(sess, fmt.Sprintf("TOUCH test_queue %v %v 30", id, receipt))
+
+	if resp != "+OK\r\n" {
+		t.Error("Touch failed, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, fmt.Sprintf("TOUCH test_queue %v nope 30", id))
+
+	if resp != "-ERR Stale receipt.\r\n" {
+		t.Error("Touch with the wrong receipt should fail, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, fmt.Sprintf("TOUCH test_queue %v %v soon", id, receipt))
+
+	if resp != "-ERR Invalid number of seconds.\r\n" {
+		t.Error("Touch with bad seconds should fail, got: ", resp)
+	}
+
+	// RELEASE command
+	resp = s.Dispatch(sess, fmt.Sprintf("RELEASE test_queue %v %v", id, receipt))
+
+	if resp != "+OK\r\n" {
+		t.Error("Release failed, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, fmt.Sprintf("RELEASE test_queue %v %v", id, receipt))
+
+	if resp != "-ERR Stale receipt.\r\n" {
+		t.Error("Releasing twice should fail, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, "RESERVE test_queue")
+	bits = strings.SplitN(resp, " ", 3)
+	receipt = bits[1]
+
 	// RETRY command
-	resp = s.HandleRetry(fmt.Sprintf("RETRY test_queue %v", id))
+	resp = s.Dispatch(sess, fmt.Sprintf("RETRY test_queue %v %v", id, receipt))
 
 	if resp != "+OK\r\n" {
 		t.Error("Retry failed, got: ", resp)
 	}
 
 	// DONE command
-	resp = s.HandleDone(fmt.Sprintf("DONE test_queue %v", id))
+	resp = s.Dispatch(sess, fmt.Sprintf("DONE test_queue %v %v", id, receipt))
+
+	if resp != "-ERR Stale receipt.\r\n" {
+		t.Error("Done with a released receipt should fail, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, "RESERVE test_queue")
+	bits = strings.SplitN(resp, " ", 3)
+	receipt = bits[1]
+	resp = s.Dispatch(sess, fmt.Sprintf("DONE test_queue %v %v", id, receipt))
 
 	if resp != "+OK\r\n" {
 		t.Error("Done failed, got: ", resp)
 	}
+
+	resp = s.Dispatch(sess, fmt.Sprintf("DONE test_queue %v %v", id, receipt))
+
+	if resp != "-ERR No such Id.\r\n" {
+		t.Error("Done on a removed item should fail, got: ", resp)
+	}
+}
+
+func TestServerReleaseOnClose(t *testing.T) {
+	s := server.New(13331)
+	s.ReleaseOnClose = true
+	s.Dispatch(server.NewSession("1", nil), "ADD test_queue 3 Hello")
+
+	client, conn := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		s.Handle(conn)
+		done <- true
+	}()
+
+	reader := bufio.NewReader(client)
+	fmt.Fprint(client, "RESERVE test_queue\r\n")
+	resp, _ := reader.ReadString('\n')
+
+	if !strings.HasPrefix(resp, "+") {
+		t.Error("Reserve failed, got: ", resp)
+	}
+
+	if s.GetQueue("test_queue").Len() != 0 {
+		t.Error("Item should be reserved.")
+	}
+
+	client.Close()
+	<-done
+
+	q := s.GetQueue("test_queue")
+
+	if q.Len() != 1 {
+		t.Error("Item wasn't released on disconnect.")
+	}
+
+	if q.Items[0].RemainingRetries != 3 {
+		t.Error("Releasing used a retry, saw: ", q.Items[0].RemainingRetries)
+	}
+}
+
+func TestServerPruneSession(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	other := server.NewSession("2", nil)
+	s.Dispatch(sess, "ADD test_queue 0 Hello")
+	s.Dispatch(sess, "ADD test_queue 0 Again")
+
+	bits := strings.Fields(s.Dispatch(sess, "RESERVE test_queue"))
+	id, receipt := strings.TrimPrefix(bits[0], "+"), bits[1]
+
+	// Finished by another client, so the Session no longer holds it.
+	s.Dispatch(other, fmt.Sprintf("DONE test_queue %s %s", id, receipt))
+	s.Dispatch(sess, "RESERVE test_queue")
+
+	if len(sess.Reservations) != 1 {
+		t.Error("Reservations that are no longer held should be forgotten, saw: ", sess.Reservations)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := server.New(0)
+	running := make(chan error)
+
+	go func() {
+		running <- s.Run()
+	}()
+
+	client, conn := net.Pipe()
+	done := make(chan bool)
+
+	go func() {
+		s.Handle(conn)
+		done <- true
+	}()
+
+	reader := bufio.NewReader(client)
+	fmt.Fprint(client, "LEN test_queue\r\n")
+	resp, _ := reader.ReadString('\n')
+
+	if resp != ":0\r\n" {
+		t.Error("Len failed, got: ", resp)
+	}
+
+	shutdown := make(chan error)
+
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	resp, _ = reader.ReadString('\n')
+
+	if resp != "-ERR Server shutting down.\r\n" {
+		t.Error("Client wasn't notified of the shutdown, got: ", resp)
+	}
+
+	<-done
+
+	if err := <-shutdown; err != nil {
+		t.Error("Shutdown failed: ", err)
+	}
+
+	if err := <-running; err != server.ServerClosed {
+		t.Error("Run should return ServerClosed, got: ", err)
+	}
+
+	if err := s.Run(); err != server.ServerClosed {
+		t.Error("Run after Shutdown should return ServerClosed, got: ", err)
+	}
+}
+
+func TestServerServe(t *testing.T) {
+	s := server.New(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen: ", err)
+	}
+
+	serving := make(chan error)
+
+	go func() {
+		serving <- s.Serve(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+
+	if err != nil {
+		t.Fatal("Couldn't connect: ", err)
+	}
+
+	defer c.Close()
+
+	reader := bufio.NewReader(c)
+	fmt.Fprint(c, "LEN test_queue\r\n")
+	resp, _ := reader.ReadString('\n')
+
+	if resp != ":0\r\n" {
+		t.Error("Len failed, got: ", resp)
+	}
+
+	s.Shutdown(context.Background())
+
+	if err := <-serving; err != server.ServerClosed {
+		t.Error("Serve should return ServerClosed, got: ", err)
+	}
+}
+
+func TestServerSocket(t *testing.T) {
+	s := server.New(0)
+	s.Host = "127.0.0.1"
+	s.Socket = filepath.Join(t.TempDir(), "takeanumber.sock")
+	s.SocketMode = 0600
+	running := make(chan error)
+
+	go func() {
+		running <- s.Run()
+	}()
+
+	var c net.Conn
+	var err error
+
+	for n := 0; n < 100; n++ {
+		if c, err = net.Dial("unix", s.Socket); err == nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatal("Couldn't connect: ", err)
+	}
+
+	defer c.Close()
+
+	fi, _ := os.Stat(s.Socket)
+
+	if fi.Mode().Perm() != 0600 {
+		t.Error("Socket permissions are wrong, saw: ", fi.Mode().Perm())
+	}
+
+	reader := bufio.NewReader(c)
+	fmt.Fprint(c, "LEN test_queue\r\n")
+	resp, _ := reader.ReadString('\n')
+
+	if resp != ":0\r\n" {
+		t.Error("Len failed, got: ", resp)
+	}
+
+	// A second server can't take over a socket that's in use.
+	other := server.New(0)
+	other.Socket = s.Socket
+
+	if _, err := other.ListenSocket(); err == nil {
+		t.Error("Listening on a socket in use should fail.")
+	}
+
+	s.Shutdown(context.Background())
+
+	if err := <-running; err != server.ServerClosed {
+		t.Error("Run should return ServerClosed, got: ", err)
+	}
+
+	// Only the socket, without TCP.
+	s = server.New(0)
+	s.SocketOnly = true
+
+	if _, err := s.Listen(); err == nil {
+		t.Error("SocketOnly without a Socket should fail.")
+	}
+
+	s.Socket = other.Socket
+	listeners, err := s.Listen()
+
+	if err != nil || len(listeners) != 1 {
+		t.Error("Expected only the socket listener, saw: ", listeners, err)
+	}
+
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	s := server.New(0)
+	s.MaxConnections = 2
+	s.MaxConnectionsPerIP = 1
+	s.IdleTimeout = 100 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen: ", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	first, _ := net.Dial("tcp", l.Addr().String())
+	defer first.Close()
+	reader := bufio.NewReader(first)
+	fmt.Fprint(first, "LEN test_queue\r\n")
+	reader.ReadString('\n')
+
+	// A second connection from the same IP is turned away.
+	second, _ := net.Dial("tcp", l.Addr().String())
+	defer second.Close()
+	resp, _ := bufio.NewReader(second).ReadString('\n')
+
+	if resp != "-ERR Too many connections.\r\n" {
+		t.Error("Second connection should be rejected, got: ", resp)
+	}
+
+	// The first is disconnected once it's idle.
+	resp, _ = reader.ReadString('\n')
+
+	if resp != "-ERR Idle timeout.\r\n" {
+		t.Error("Idle connection should time out, got: ", resp)
+	}
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Idle connection should be closed.")
+	}
+
+	// Once it has gone, there's room for another.
+	third, _ := net.Dial("tcp", l.Addr().String())
+	defer third.Close()
+	reader = bufio.NewReader(third)
+	fmt.Fprint(third, "STATS\r\n")
+	resp, _ = reader.ReadString('\n')
+
+	if resp != "+connections=1 queues=1 paused=0 accepted=2 rejected=1 timed_out=1 closed=1 purged=0 removed=0\r\n" {
+		t.Error("Stats are wrong, got: ", resp)
+	}
+
+	// The global limit applies across IPs.
+	s = server.New(0)
+	s.MaxConnections = 1
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen: ", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	fourth, _ := net.Dial("tcp", l.Addr().String())
+	defer fourth.Close()
+	fmt.Fprint(fourth, "LEN test_queue\r\n")
+	bufio.NewReader(fourth).ReadString('\n')
+
+	fifth, _ := net.Dial("tcp", l.Addr().String())
+	defer fifth.Close()
+	resp, _ = bufio.NewReader(fifth).ReadString('\n')
+
+	if resp != "-ERR Too many connections.\r\n" {
+		t.Error("Connection over the global limit should be rejected, got: ", resp)
+	}
+}
+
+func TestServerMaxSize(t *testing.T) {
+	s := server.New(0)
+	s.MaxCommandSize = 100
+	s.MaxBodySize = 10
+
+	if resp := s.Dispatch(server.NewSession("1", nil), "ADD test_queue 0 " + strings.Repeat("x", 11)); resp != "-ERR Body too large.\r\n" {
+		t.Error("Large body should be rejected, got: ", resp)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.Handle(conn)
+
+	reader := bufio.NewReader(client)
+	send := func(command string) string {
+		go fmt.Fprint(client, command+"\r\n")
+		resp, _ := reader.ReadString('\n')
+		return resp
+	}
+
+	if resp := send("ADD test_queue 0 " + strings.Repeat("x", 70000)); resp != "-ERR Command too large.\r\n" {
+		t.Error("Large command should be rejected, got: ", resp)
+	}
+
+	// The connection is still usable afterwards.
+	if resp := send("LEN test_queue"); resp != ":0\r\n" {
+		t.Error("Connection should still work, got: ", resp)
+	}
+
+	if resp := send("ADD test_queue 0 Hello"); !strings.HasPrefix(resp, "+") {
+		t.Error("Small body should be accepted, got: ", resp)
+	}
+}
+
+func TestServerPeekInspect(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("7", nil)
+
+	if resp := s.Dispatch(sess, "PEEK test_queue"); resp != "*0\r\n" {
+		t.Error("Peeking an empty queue should return nothing, got: ", resp)
+	}
+
+	id_1 := strings.TrimSpace(strings.TrimPrefix(s.Dispatch(sess, "ADD test_queue 3 Hello world"), "+"))
+	id_2 := strings.TrimSpace(strings.TrimPrefix(s.Dispatch(sess, "ADD test_queue 1 Bye"), "+"))
+
+	if resp := s.Dispatch(sess, "PEEK test_queue 5"); resp != fmt.Sprintf("*2\r\n+%s Hello world\r\n+%s Bye\r\n", id_1, id_2) {
+		t.Error("Peek returned the wrong items, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "PEEK test_queue 0"); resp != "-ERR Invalid count.\r\n" {
+		t.Error("Peek with a bad count should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "LEN test_queue"); resp != ":2\r\n" {
+		t.Error("Peek shouldn't reserve anything, got: ", resp)
+	}
+
+	resp := s.Dispatch(sess, "INSPECT test_queue "+id_1)
+
+	if !strings.Contains(resp, "state=ready reserved=false initial_retries=3 remaining_retries=3 ") || !strings.Contains(resp, " owner=- group=- body=Hello world\r\n") {
+		t.Error("Inspect returned the wrong state, got: ", resp)
+	}
+
+	s.Dispatch(sess, "RESERVE test_queue 30")
+	resp = s.Dispatch(sess, "INSPECT test_queue "+id_1)
+
+	if !strings.Contains(resp, "state=reserved reserved=true ") || !strings.Contains(resp, " owner=7 ") || strings.Contains(resp, "expires=- ") {
+		t.Error("Inspect returned the wrong reserved state, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "INSPECT test_queue nope"); resp != "-ERR No such Id.\r\n" {
+		t.Error("Inspecting a missing item should fail, got: ", resp)
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	ids := []string{}
+
+	for n := 0; n < 3; n++ {
+		resp := s.Dispatch(sess, fmt.Sprintf("ADD test_queue 0 Item %d %s", n, strings.Repeat("x", 100)))
+		ids = append(ids, strings.TrimSpace(strings.TrimPrefix(resp, "+")))
+	}
+
+	s.Dispatch(sess, "RESERVE test_queue")
+
+	resp := s.Dispatch(sess, "SCAN test_queue 0 COUNT 2")
+	lines := strings.Split(resp, "\r\n")
+
+	if lines[0] != "*3" || lines[1] == "+0" || !strings.HasPrefix(lines[2], "+"+ids[0]+" reserved Item 0 ") || !strings.HasSuffix(lines[2], "...") {
+		t.Error("First SCAN is wrong, got: ", resp)
+	}
+
+	cursor := strings.TrimPrefix(lines[1], "+")
+	resp = s.Dispatch(sess, "SCAN test_queue "+cursor+" COUNT 2")
+
+	if !strings.HasPrefix(resp, "*2\r\n+0\r\n+"+ids[2]+" ready ") {
+		t.Error("Second SCAN is wrong, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, "SCAN test_queue 0 state RESERVED")
+
+	if !strings.HasPrefix(resp, "*2\r\n+0\r\n+"+ids[0]+" reserved ") {
+		t.Error("SCAN by state is wrong, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "SCAN test_queue 0 MINAGE 60"); resp != "*1\r\n+0\r\n" {
+		t.Error("SCAN by age is wrong, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "SCAN test_queue 0 STATE nope"); resp != "-ERR Invalid state.\r\n" {
+		t.Error("SCAN with a bad state should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "SCAN test_queue 0 COUNT"); resp != "-ERR Missing SCAN parameters.\r\n" {
+		t.Error("SCAN with a missing value should fail, got: ", resp)
+	}
+}
+
+func TestServerPurge(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	id := strings.TrimSpace(strings.TrimPrefix(s.Dispatch(sess, "ADD test_queue 0 Hello"), "+"))
+	s.Dispatch(sess, "ADD test_queue 0 Again")
+	s.Dispatch(sess, "ADD test_queue 0 More")
+	s.Dispatch(sess, "RESERVE test_queue")
+
+	if resp := s.Dispatch(sess, "PURGE test_queue nope"); resp != "-ERR Invalid state.\r\n" {
+		t.Error("PURGE with a bad state should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "PURGE test_queue READY"); resp != ":2\r\n" {
+		t.Error("PURGE ready removed the wrong items, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "REMOVE test_queue "+id); resp != ":1\r\n" {
+		t.Error("REMOVE failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "REMOVE test_queue "+id); resp != "-ERR No such Id.\r\n" {
+		t.Error("REMOVE on a missing item should fail, got: ", resp)
+	}
+
+	s.Dispatch(sess, "ADD test_queue 0 Last")
+
+	if resp := s.Dispatch(sess, "PURGE test_queue"); resp != ":1\r\n" {
+		t.Error("PURGE removed the wrong items, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "STATS"); !strings.HasSuffix(resp, " purged=3 removed=1\r\n") {
+		t.Error("Stats should count purged & removed items, got: ", resp)
+	}
+}
+
+func TestServerPause(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	s.Dispatch(sess, "ADD test_queue 0 Hello")
+
+	if resp := s.Dispatch(sess, "PAUSE test_queue"); resp != "+OK\r\n" {
+		t.Error("PAUSE failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue"); resp != "-ERR No items available to reserve.\r\n" {
+		t.Error("A paused queue shouldn't hand out items, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue 0 Again"); !strings.HasPrefix(resp, "+") {
+		t.Error("A paused queue should still accept items, got: ", resp)
+	}
+
+	s.Dispatch(sess, "ADD other_queue 0 Hello")
+
+	if resp := s.Dispatch(sess, "QUEUES"); resp != "*2\r\n+other_queue len=1 paused=false\r\n+test_queue len=2 paused=true\r\n" {
+		t.Error("QUEUES is wrong, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "STATS"); !strings.HasPrefix(resp, "+connections=0 queues=2 paused=1 ") {
+		t.Error("STATS should count paused queues, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESUME test_queue"); resp != "+OK\r\n" {
+		t.Error("RESUME failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue"); !strings.Contains(resp, " Hello\r\n") {
+		t.Error("A resumed queue should hand out items, got: ", resp)
+	}
+}
+
+func TestServerMove(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	id := strings.TrimSpace(strings.TrimPrefix(s.Dispatch(sess, "ADD emails 3 Hello"), "+"))
+	s.Dispatch(sess, "ADD emails 0 Again")
+	s.Dispatch(sess, "ADD emails 0 More")
+
+	if resp := s.Dispatch(sess, "MOVE emails emails"); resp != "-ERR Source & destination queues are the same.\r\n" {
+		t.Error("MOVE to the same queue should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE emails emails.slow ID "+id); resp != ":1\r\n" {
+		t.Error("MOVE by Id failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE emails emails.slow 1"); resp != ":1\r\n" {
+		t.Error("MOVE with a count failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE emails emails.slow nope"); resp != "-ERR Invalid count.\r\n" {
+		t.Error("MOVE with a bad count should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE emails emails.slow"); resp != ":1\r\n" {
+		t.Error("MOVE everything failed, got: ", resp)
+	}
+
+	resp := s.Dispatch(sess, "INSPECT emails.slow "+id)
+
+	if !strings.Contains(resp, " remaining_retries=3 ") || !strings.HasSuffix(resp, " body=Hello\r\n") {
+		t.Error("The moved item should be intact, got: ", resp)
+	}
+
+	// Both queues must be permitted.
+	p, _ := server.ParsePermission("MOVE:emails*")
+	sess.User = &server.User{Name: "ops", Permissions: []*server.Permission{p}}
+
+	if resp := s.Dispatch(sess, "MOVE emails.slow sms"); resp != "-ERR NOPERM Not permitted to run this command on this queue.\r\n" {
+		t.Error("MOVE to a queue that isn't permitted should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE emails.slow emails"); resp != ":3\r\n" {
+		t.Error("MOVE between permitted queues failed, got: ", resp)
+	}
+}
+
+func TestServerDedup(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+	id := s.Dispatch(sess, "ADD test_queue KEY order-1 0 Hello")
+
+	if resp := s.Dispatch(sess, "ADD test_queue key order-1 0 Hello again"); resp != id {
+		t.Error("A duplicate ADD should return the original Id, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "LEN test_queue"); resp != ":1\r\n" {
+		t.Error("A duplicate ADD shouldn't add an item, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD other_queue KEY order-1 0 Hello"); resp == id {
+		t.Error("Keys should be per-queue, got: ", resp)
+	}
+
+	for _, body := range []string{"KEY is part of the body", "Id 42 was updated", "-- dashes too"} {
+		resp := s.Dispatch(sess, "ADD test_queue 0 "+body)
+		resp = s.Dispatch(sess, "INSPECT test_queue "+strings.TrimSpace(strings.TrimPrefix(resp, "+")))
+
+		if !strings.HasSuffix(resp, " body="+body+"\r\n") {
+			t.Error("A body that looks like an option should be added as-is, got: ", resp)
+		}
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue NOPE order-2 0 Hello"); resp != "-ERR Invalid number of retries.\r\n" {
+		t.Error("An unknown option should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue KEY order-2 0"); resp != "-ERR Missing ADD parameters.\r\n" {
+		t.Error("Options without a body should fail, got: ", resp)
+	}
+
+	s.DedupWindow = 0
+
+	if resp := s.Dispatch(sess, "ADD test_queue KEY order-1 0 Hello"); resp == id {
+		t.Error("Deduplication should be disabled, got: ", resp)
+	}
+}
+
+func TestServerClientId(t *testing.T) {
+	s := server.New(0)
+	sess := server.NewSession("1", nil)
+
+	if resp := s.Dispatch(sess, "ADD test_queue ID order-123 0 Hello"); resp != "+order-123\r\n" {
+		t.Error("ADD with an Id failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ID order-123 0 Again"); resp != "-ERR Duplicate Id.\r\n" {
+		t.Error("ADD with a duplicate Id should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD other_queue ID order-123 0 Hello"); resp != "+order-123\r\n" {
+		t.Error("Ids should be per-queue, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ID caf\u00e9 0 Hello"); resp != "-ERR Invalid Id.\r\n" {
+		t.Error("ADD with a bad Id should fail, got: ", resp)
+	}
+
+	resp := s.Dispatch(sess, "RESERVE test_queue")
+
+	if !strings.HasPrefix(resp, "+order-123 ") {
+		t.Error("RESERVE should return the supplied Id, got: ", resp)
+	}
+	for _, word := range []string{"id", "Id", "group", "attr"} {
+		resp := s.Dispatch(sess, "ADD test_queue 0 "+word+" 42 was updated")
+
+		if resp == "+42\r\n" || strings.HasPrefix(resp, "-ERR") {
+			t.Error("An option's keyword at the start of a body should be left alone, got: ", resp)
+		}
+	}
+}
+
+func TestServerIds(t *testing.T) {
+	s := server.New(0)
+	s.Ids = idgen.NewSequence()
+	sess := server.NewSession("1", nil)
+
+	if resp := s.Dispatch(sess, "ADD test_queue 0 Hello"); resp != "+1\r\n" {
+		t.Error("The generator should create the Id, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ID mine 0 Hello"); resp != "+mine\r\n" {
+		t.Error("A supplied Id should be used instead, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue 0 Again"); resp != "+2\r\n" {
+		t.Error("The generator should count up, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD other_queue 0 Hello"); resp != "+1\r\n" {
+		t.Error("Each queue should be numbered separately, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ID 4 0 Mine"); resp != "+4\r\n" {
+		t.Error("A supplied numeric Id should be used, got: ", resp)
+	}
+
+	s.Dispatch(sess, "ADD test_queue KEY order-1 0 Keyed")
+
+	if resp := s.Dispatch(sess, "ADD test_queue KEY order-1 0 Keyed"); resp != "+3\r\n" {
+		t.Error("A duplicate ADD should return the original Id, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue 0 Skipped"); resp != "+5\r\n" {
+		t.Error("Generated Ids should skip duplicates & Ids in use, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "MOVE other_queue test_queue"); resp != ":0\r\n" {
+		t.Error("Items whose Id is in the other queue should stay put, got: ", resp)
+	}
+}
+
+func TestServerAttributes(t *testing.T) {
+	s := server.New(0)
+	s.Ids = idgen.NewSequence()
+	s.MaxBodySize = 20
+	sess := server.NewSession("1", nil)
+
+	if resp := s.Dispatch(sess, "ADD test_queue ATTR trace=abc ATTR tenant=7 0 Hello"); resp != "+1\r\n" {
+		t.Error("ADD with attributes failed, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ATTR trace 0 Hello"); resp != "-ERR Invalid attribute.\r\n" {
+		t.Error("ADD with a malformed attribute should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue ATTR trace=abc ATTR tenant=77 0 Hello"); resp != "-ERR Body too large.\r\n" {
+		t.Error("Attributes should count towards the body size, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "ADD test_queue 0 Plain"); resp != "+2\r\n" {
+		t.Error("ADD without attributes failed, got: ", resp)
+	}
+
+	resp := s.Dispatch(sess, "INSPECT test_queue 1")
+
+	if !strings.HasSuffix(resp, " owner=- group=- attr.tenant=7 attr.trace=abc body=Hello\r\n") {
+		t.Error("INSPECT should include the attributes, got: ", resp)
+	}
+
+	resp = s.Dispatch(sess, "RESERVE test_queue 30 ATTRS")
+	lines := strings.Split(resp, "\r\n")
+
+	if len(lines) != 5 || lines[0] != "*3" || !strings.HasPrefix(lines[1], "+1 ") || !strings.HasSuffix(lines[1], " Hello") || lines[2] != "+tenant=7" || lines[3] != "+trace=abc" {
+		t.Error("RESERVE with ATTRS should include the attributes, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue attrs"); !strings.HasPrefix(resp, "*1\r\n+2 ") {
+		t.Error("RESERVE with ATTRS should work without attributes, got: ", resp)
+	}
+}
+
+func TestServerGroups(t *testing.T) {
+	s := server.New(0)
+	s.Ids = idgen.NewSequence()
+	sess := server.NewSession("1", nil)
+
+	s.Dispatch(sess, "ADD test_queue GROUP user-a 0 First")
+	s.Dispatch(sess, "ADD test_queue GROUP user-a 0 Second")
+	s.Dispatch(sess, "ADD test_queue GROUP user-b 0 Other")
+
+	if resp := s.Dispatch(sess, "ADD test_queue GROUP caf\u00e9 0 Hello"); resp != "-ERR Invalid group.\r\n" {
+		t.Error("ADD with a bad group should fail, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "INSPECT test_queue 1"); !strings.Contains(resp, " group=user-a ") {
+		t.Error("INSPECT should include the group, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue"); !strings.HasPrefix(resp, "+1 ") {
+		t.Error("RESERVE should return the first item, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue"); !strings.HasPrefix(resp, "+3 ") {
+		t.Error("RESERVE should skip the group in flight, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "RESERVE test_queue"); resp != "-ERR No items available to reserve.\r\n" {
+		t.Error("RESERVE should hold back both groups, got: ", resp)
+	}
+}
+
+func TestServerWhitespace(t *testing.T) {
+	s := server.New(0)
+	s.Ids = idgen.NewSequence()
+	sess := server.NewSession("1", nil)
+	s.Dispatch(sess, "ADD test_queue 0 Hello")
+
+	if resp := s.Dispatch(sess, "INSPECT test_queue\t1"); !strings.HasPrefix(resp, "+id=1 ") {
+		t.Error("INSPECT should accept tab-separated parameters, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "REMOVE test_queue\t1"); resp != ":1\r\n" {
+		t.Error("REMOVE should accept tab-separated parameters, got: ", resp)
+	}
+
+	s.Dispatch(sess, "PAUSE  test_queue")
+
+	if !s.GetQueue("test_queue").IsPaused() {
+		t.Error("PAUSE should ignore repeated spaces.")
+	}
+
+	if resp := s.Dispatch(sess, "ADD\ttest_queue  KEY\tk 0 Hello,  world"); resp != "+2\r\n" {
+		t.Error("ADD should accept any whitespace between parameters, got: ", resp)
+	}
+
+	if resp := s.Dispatch(sess, "PEEK test_queue"); resp != "*1\r\n+2 Hello,  world\r\n" {
+		t.Error("ADD should keep the body as it was sent, got: ", resp)
+	}
+}
+
+func TestRequestTail(t *testing.T) {
+	req := server.NewRequest("add  q\tKEY k 0 Hello,  world")
+
+	if req.Words[0] != "ADD" || len(req.Words) != 7 {
+		t.Error("NewRequest should split on any whitespace: ", req.Words)
+	}
+
+	if tail := req.Tail(5); tail != "Hello,  world" {
+		t.Error("Tail should keep the rest of the line as-is: ", tail)
+	}
+
+	if tail := req.Tail(7); tail != "" {
+		t.Error("Tail should be empty past the last word: ", tail)
+	}
 }
@@ -0,0 +1,51 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+)
+
+// A Reservation records an item reserved by a Session.
+type Reservation struct {
+	Queue   string
+	Id      string
+	Receipt string
+}
+
+// A Session holds the state of a single client connection.
+//
+// Once the client has authenticated, Authenticated is set, along with the
+// User it authenticated as (nil when using the server's Password). Closed is
+// set once the client asks to CLOSE the connection.
+type Session struct {
+	Id            string
+	Conn          net.Conn
+	Reservations  map[string]Reservation
+	Authenticated bool
+	User          *User
+	Closed        bool
+}
+
+// Records an item reserved by the Session.
+//
+// Accepts the name (string) of the queue, the Id (string) of the item & the
+// receipt (string) of the reservation.
+func (sess *Session) Track(queue string, id string, receipt string) {
+	sess.Reservations[receipt] = Reservation{queue, id, receipt}
+}
+
+// Stops tracking a reservation, once it has been finished with.
+//
+// Accepts the receipt (string) of the reservation.
+func (sess *Session) Forget(receipt string) {
+	delete(sess.Reservations, receipt)
+}
+
+// NewSession creates a new Session instance for a connection.
+func NewSession(id string, c net.Conn) *Session {
+	rs := map[string]Reservation{}
+	return &Session{Id: id, Conn: c, Reservations: rs}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stats holds counters about the server's connections, along with the
+// items operators have removed by PURGE or REMOVE.
+//
+// The counters are updated atomically & should be read with Snapshot.
+type Stats struct {
+	Accepted uint64
+	Rejected uint64
+	TimedOut uint64
+	Closed   uint64
+	Purged   uint64
+	Removed  uint64
+}
+
+// Returns a copy of the Stats, safe to read while the server is running.
+func (st *Stats) Snapshot() Stats {
+	return Stats{
+		Accepted: atomic.LoadUint64(&st.Accepted),
+		Rejected: atomic.LoadUint64(&st.Rejected),
+		TimedOut: atomic.LoadUint64(&st.TimedOut),
+		Closed:   atomic.LoadUint64(&st.Closed),
+		Purged:   atomic.LoadUint64(&st.Purged),
+		Removed:  atomic.LoadUint64(&st.Removed),
+	}
+}
+
+// Returns the Stats formatted as space-separated "name=value" pairs.
+func (st Stats) String() string {
+	return fmt.Sprintf(
+		"accepted=%d rejected=%d timed_out=%d closed=%d purged=%d removed=%d",
+		st.Accepted,
+		st.Rejected,
+		st.TimedOut,
+		st.Closed,
+		st.Purged,
+		st.Removed,
+	)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+)
+
+// A Certificate is a TLS certificate loaded from files, which can be reloaded
+// while the server is running (for instance, once it has been renewed).
+type Certificate struct {
+	CertFile string
+	KeyFile  string
+	cert     *tls.Certificate
+	lock     *sync.RWMutex
+}
+
+// Reloads the certificate & key from their files.
+//
+// If they can't be loaded, the previous certificate is kept & an error is
+// returned.
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert = &cert
+	return nil
+}
+
+// Returns the current certificate, for use as tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cert, nil
+}
+
+// LoadCertificate creates a new Certificate instance from a certificate &
+// key file (both PEM encoded).
+func LoadCertificate(certFile string, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile, keyFile, nil, &sync.RWMutex{}}
+	err := c.Reload()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewTLSConfig creates a TLS configuration for the server.
+//
+// Accepts the server's Certificate & the path (string) of a PEM encoded CA
+// bundle. If the path is provided, clients must present a certificate signed
+// by one of those CAs (mutual TLS). If it's empty, client certificates aren't
+// requested.
+func NewTLSConfig(cert *Certificate, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No client CA certificates found.")
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
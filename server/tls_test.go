@@ -0,0 +1,141 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/toastdriven/takeanumber/client"
+	"github.com/toastdriven/takeanumber/server"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a certificate signed by parent (or self-signed, if parent is nil) &
+// writes it & its key to PEM files in dir.
+//
+// Returns the certificate, its key & the paths of the cert & key files.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal("Couldn't generate key: ", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatal("Couldn't create certificate: ", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := writeCert(t, dir, "server", ca, caKey)
+	_, _, clientCertFile, clientKeyFile := writeCert(t, dir, "client", ca, caKey)
+
+	cert, err := server.LoadCertificate(certFile, keyFile)
+
+	if err != nil {
+		t.Fatal("Couldn't load certificate: ", err)
+	}
+
+	config, err := server.NewTLSConfig(cert, caFile)
+
+	if err != nil {
+		t.Fatal("Couldn't create TLS config: ", err)
+	}
+
+	s := server.New(0)
+	s.Host = "127.0.0.1"
+	s.TLSConfig = config
+	l, err := s.ListenTCP()
+
+	if err != nil {
+		t.Fatal("Couldn't listen: ", err)
+	}
+
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, _ := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	ctx := context.Background()
+
+	// With a client certificate.
+	c := client.New(l.Addr().String())
+	c.TLSConfig = &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+	defer c.Close()
+
+	if _, err := c.Len(ctx, "test_queue"); err != nil {
+		t.Error("Len over TLS failed: ", err)
+	}
+
+	// Without a client certificate.
+	anon := client.New(l.Addr().String())
+	anon.TLSConfig = &tls.Config{RootCAs: roots}
+	defer anon.Close()
+
+	if _, err := anon.Len(ctx, "test_queue"); err == nil {
+		t.Error("Connecting without a client certificate should fail.")
+	}
+
+	// Reloading picks up a renewed certificate.
+	renewed, _, _, _ := writeCert(t, dir, "server", ca, caKey)
+
+	if err := cert.Reload(); err != nil {
+		t.Error("Reload failed: ", err)
+	}
+
+	current, _ := cert.GetCertificate(nil)
+
+	if current.Leaf != nil && !current.Leaf.Equal(renewed) {
+		t.Error("Reload didn't pick up the renewed certificate.")
+	}
+
+	// A failed reload keeps the current certificate.
+	os.WriteFile(certFile, []byte("nope"), 0600)
+
+	if cert.Reload() == nil {
+		t.Error("Reloading a bad certificate should fail.")
+	}
+
+	if after, _ := cert.GetCertificate(nil); after != current {
+		t.Error("A failed reload shouldn't replace the certificate.")
+	}
+}
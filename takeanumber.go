@@ -35,14 +35,14 @@ session:
 	LEN my_queue
 	:2
 	RESERVE my_queue
-	+bb713fbe-3c82-41c9-94f0-43c499bfac8c Hello, world!
-	DONE my_queue bb713fbe-3c82-41c9-94f0-43c499bfac8c
+	+bb713fbe-3c82-41c9-94f0-43c499bfac8c 5f0e6b52-1d0c-4a8e-9c4f-2b1d7e3a9f60 Hello, world!
+	DONE my_queue bb713fbe-3c82-41c9-94f0-43c499bfac8c 5f0e6b52-1d0c-4a8e-9c4f-2b1d7e3a9f60
 	+OK
 	LEN my_queue
 	:1
 	RESERVE my_queue
-	+4aaf88df-390b-4a0a-8352-1fe258d94d3d {"user_id": 5, "action": "send_welcome_email"}
-	RETRY my_queue 4aaf88df-390b-4a0a-8352-1fe258d94d3d
+	+4aaf88df-390b-4a0a-8352-1fe258d94d3d 9c2d41f7-8b3e-4f06-a5d1-7e6c0b2f8a13 {"user_id": 5, "action": "send_welcome_email"}
+	RETRY my_queue 4aaf88df-390b-4a0a-8352-1fe258d94d3d 9c2d41f7-8b3e-4f06-a5d1-7e6c0b2f8a13
 	+OK
 	LEN my_queue
 	:1
@@ -63,21 +63,170 @@ This session did the following:
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/toastdriven/takeanumber/idgen"
 	"github.com/toastdriven/takeanumber/server"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const Version = "1.0.0"
 
 func main() {
+	var host string
 	var port int
+	var socket string
+	var socketMode string
+	var socketOnly bool
+	var tlsCert string
+	var tlsKey string
+	var tlsClientCA string
+	var password string
+	var usersFile string
+	var maxConns int
+	var maxConnsPerIP int
+	var idleTimeout int
+	var writeTimeout int
+	var maxCommandSize int
+	var maxBodySize int
+	var dedupWindow int
+	var ids string
+	var timeout int
+	var release bool
+	flag.StringVar(&host, "host", "", "The host to listen on (all interfaces if empty)")
 	flag.IntVar(&port, "p", 13331, "The port to listen on")
+	flag.StringVar(&socket, "socket", "", "The path of a Unix domain socket to listen on")
+	flag.StringVar(&socketMode, "socket-mode", "", "The permissions (octal, e.g. 0660) of the Unix domain socket")
+	flag.BoolVar(&socketOnly, "socket-only", false, "Only listen on the Unix domain socket, not the TCP port")
+	flag.StringVar(&tlsCert, "tls-cert", "", "The TLS certificate file (PEM); enables TLS on the TCP port")
+	flag.StringVar(&tlsKey, "tls-key", "", "The TLS key file (PEM)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "A CA bundle (PEM) that client certificates must be signed by")
+	flag.StringVar(&password, "password", os.Getenv("TAKEANUMBER_PASSWORD"), "A password clients must AUTH with")
+	flag.StringVar(&usersFile, "users", "", "A file of usernames & passwords clients must AUTH with")
+	flag.IntVar(&maxConns, "max-conns", 0, "The most clients that may be connected at once (0 for no limit)")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "The most clients that may be connected at once from one IP (0 for no limit)")
+	flag.IntVar(&idleTimeout, "idle-timeout", 0, "Seconds before an idle client is disconnected (0 never)")
+	flag.IntVar(&writeTimeout, "write-timeout", 0, "Seconds a client has to read a response before it's disconnected (0 never)")
+	flag.IntVar(&maxCommandSize, "max-command-size", server.DefaultMaxCommandSize, "The largest command (in bytes) a client may send")
+	flag.IntVar(&maxBodySize, "max-body-size", server.DefaultMaxBodySize, "The largest body (in bytes) an item may have")
+	flag.IntVar(&dedupWindow, "dedup-window", int(server.DefaultDedupWindow/time.Second), "Seconds ADD remembers deduplication keys for (0 disables deduplication)")
+	flag.StringVar(&ids, "ids", "uuid4", "How item Ids are created: "+strings.Join(idgen.Names, ", "))
+	flag.IntVar(&timeout, "timeout", 0, "Seconds before a reservation expires (0 never expires)")
+	flag.BoolVar(&release, "release", false, "Release a connection's reservations when it disconnects")
 	flag.Parse()
 
 	fmt.Printf("takeanumber v%v\n", Version)
 	s := server.New(port)
+	s.Host = host
+	s.Socket = socket
+	s.SocketOnly = socketOnly
+
+	if socketMode != "" {
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+
+		if err != nil {
+			log.Fatal("Invalid socket mode: ", socketMode)
+		}
+
+		s.SocketMode = os.FileMode(mode)
+	}
+	s.ReserveTimeout = time.Duration(timeout) * time.Second
+	s.ReleaseOnClose = release
+	s.MaxConnections = maxConns
+	s.MaxConnectionsPerIP = maxConnsPerIP
+	s.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	s.WriteTimeout = time.Duration(writeTimeout) * time.Second
+	s.MaxCommandSize = maxCommandSize
+	s.MaxBodySize = maxBodySize
+	s.DedupWindow = time.Duration(dedupWindow) * time.Second
+
+	generator, err := idgen.New(ids)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.Ids = generator
+
+	// Shut down gracefully on SIGTERM/SIGINT, giving clients a few seconds to
+	// finish what they're doing. Run returns as soon as the listeners close,
+	// so main waits on done for the connections to finish.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		fmt.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	s.Password = password
+
+	if usersFile != "" {
+		users, err := server.LoadUsers(usersFile)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Users = users
+	}
+
+	if tlsCert != "" {
+		cert, err := server.LoadCertificate(tlsCert, tlsKey)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.TLSConfig, err = server.NewTLSConfig(cert, tlsClientCA)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Reload the certificate on SIGHUP, so it can be renewed without a
+		// restart.
+		go func() {
+			reloads := make(chan os.Signal, 1)
+			signal.Notify(reloads, syscall.SIGHUP)
+
+			for range reloads {
+				if err := cert.Reload(); err != nil {
+					log.Print("Couldn't reload the TLS certificate: ", err)
+					continue
+				}
+
+				fmt.Println("Reloaded the TLS certificate")
+			}
+		}()
+	}
+
+	if !s.SocketOnly {
+		fmt.Printf("Listening on %v\n", s.Address())
+	}
+
+	if s.Socket != "" {
+		fmt.Printf("Listening on %v\n", s.Socket)
+	}
+
+	err = s.Run()
+
+	if err != nil && err != server.ServerClosed {
+		log.Fatal(err)
+	}
 
-	fmt.Printf("Listening on port %v\n", port)
-	s.Run()
+	<-done
 }
@@ -15,8 +15,8 @@ Usage::
     >>> c.len('my_queue')
     1
     >>> c.reserve('my_queue')
-    ('4488ea2c-197d-4443-9467-74f75317917c', 'Hello, world!')
-    >>> c.done('my_queue', '4488ea2c-197d-4443-9467-74f75317917c')
+    ('4488ea2c-197d-4443-9467-74f75317917c', '5f0e6b52-1d0c-4a8e-9c4f-2b1d7e3a9f60', 'Hello, world!')
+    >>> c.done('my_queue', '4488ea2c-197d-4443-9467-74f75317917c', '5f0e6b52-1d0c-4a8e-9c4f-2b1d7e3a9f60')
     'OK'
     >>> c.close()
 
@@ -30,42 +30,99 @@ class EmptyQueueError(TakeANumberError): pass
 class MissingParmetersError(TakeANumberError): pass
 class InvalidRetriesError(TakeANumberError): pass
 class NoRetriesRemainingError(TakeANumberError): pass
+class NotReservedError(TakeANumberError): pass
+class NoSuchIdError(TakeANumberError): pass
+class StaleReceiptError(TakeANumberError): pass
+class AuthError(TakeANumberError): pass
+class TooLargeError(TakeANumberError): pass
+class StillReservedError(TakeANumberError): pass
+class SplitGroupError(TakeANumberError): pass
+class DuplicateIdError(TakeANumberError): pass
+class InvalidIdError(TakeANumberError): pass
+class InvalidAttributeError(TakeANumberError): pass
+class InvalidGroupError(TakeANumberError): pass
 
 
 class Client(object):
-    def __init__(self, host='127.0.0.1', port=13331, timeout=30):
+    def __init__(self, host='127.0.0.1', port=13331, timeout=30, path=None,
+                 ssl_context=None, username=None, password=None):
         self.host = host
         self.port = port
         self.timeout = timeout
+        # If a path is provided, connect to that Unix domain socket instead.
+        self.path = path
+        # If an ``ssl.SSLContext`` is provided, connect using TLS.
+        self.ssl_context = ssl_context
+        # If a password is provided, ``AUTH`` on connecting.
+        self.username = username
+        self.password = password
         self.sock = None
+        # Anything read past the end of the last line.
+        self.buffer = b''
 
     def connect(self):
+        self.buffer = b''
+
+        if self.path is not None:
+            self.sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+            self.sock.settimeout(self.timeout)
+            self.sock.connect(self.path)
+            self.auth()
+            return
+
         self.sock = socket.create_connection(
             (self.host, self.port),
             self.timeout
         )
 
+        if self.ssl_context is not None:
+            self.sock = self.ssl_context.wrap_socket(
+                self.sock,
+                server_hostname=self.host
+            )
+
+        self.auth()
+
+    def auth(self):
+        if self.password is None:
+            return
+
+        if self.username is None:
+            command = "AUTH {}\r\n".format(self.password)
+        else:
+            command = "AUTH {} {}\r\n".format(self.username, self.password)
+
+        self._send(command)
+        return self.decode(self._receive())
+
     def _send(self, command):
         sent = self.sock.sendall(command)
 
         if sent == 0:
             raise RuntimeError("Broken connection")
 
-    def _receive(self):
-        chunks = []
-
-        while True:
+    def _read_line(self):
+        while '\r\n' not in self.buffer:
             chunk = self.sock.recv(4096)
 
             if chunk == b'':
                 raise RuntimeError("Broken connection")
 
-            chunks.append(chunk)
+            self.buffer += chunk
 
-            if chunk.endswith('\r\n'):
-                break
+        line, self.buffer = self.buffer.split('\r\n', 1)
+        return line + '\r\n'
 
-        return str(b''.join(chunks))
+    def _receive(self):
+        resp = self._read_line()
+
+        if resp.startswith('*'):
+            # An array is followed by a line for each of its values, which
+            # may arrive over several reads.
+            for _ in range(int(resp[1:])):
+                resp += self._read_line()
+
+        return str(resp)
 
     def decode(self, resp):
         if resp[0] not in (':', '+', '-', '$', '*'):
@@ -74,7 +131,10 @@ class Client(object):
         resp = resp.rstrip('\r\n')
         ty, clean_resp = resp[0], resp[1:]
 
-        if ty == '+':
+        if ty == '*':
+            # An array, with a line for each of its values.
+            return [self.decode(line) for line in resp.split('\r\n')[1:]]
+        elif ty == '+':
             return clean_resp
         elif ty == ':':
             return int(clean_resp)
@@ -90,6 +150,29 @@ class Client(object):
                 raise EmptyBodyError(clean_resp)
             elif 'No items available' in clean_resp:
                 raise EmptyQueueError(clean_resp)
+            elif 'not reserved' in clean_resp:
+                raise NotReservedError(clean_resp)
+            elif 'No such Id' in clean_resp:
+                raise NoSuchIdError(clean_resp)
+            elif 'Stale receipt' in clean_resp:
+                raise StaleReceiptError(clean_resp)
+            elif 'Duplicate Id' in clean_resp:
+                raise DuplicateIdError(clean_resp)
+            elif 'Invalid Id' in clean_resp:
+                raise InvalidIdError(clean_resp)
+            elif 'Invalid attribute' in clean_resp:
+                raise InvalidAttributeError(clean_resp)
+            elif 'Invalid group' in clean_resp:
+                raise InvalidGroupError(clean_resp)
+            elif 'Item is reserved' in clean_resp:
+                raise StillReservedError(clean_resp)
+            elif 'group has other items' in clean_resp:
+                raise SplitGroupError(clean_resp)
+            elif 'too large' in clean_resp:
+                raise TooLargeError(clean_resp)
+            elif 'NOAUTH' in clean_resp or 'WRONGPASS' in clean_resp \
+                    or 'NOPERM' in clean_resp:
+                raise AuthError(clean_resp)
             else:
                 raise TakeANumberError(clean_resp)
 
@@ -105,44 +188,214 @@ class Client(object):
         self._send(command)
         return self.decode(self._receive())
 
-    def add(self, queue_name, body, retries=0):
+    def peek(self, queue_name, count=1):
         if self.sock is None:
             self.connect()
 
-        command = "ADD {} {} {}\r\n".format(
+        command = "PEEK {} {}\r\n".format(queue_name, count)
+        self._send(command)
+        return [
+            tuple(raw.split(' ', 1))
+            for raw in self.decode(self._receive())
+        ]
+
+    def inspect(self, queue_name, ident):
+        if self.sock is None:
+            self.connect()
+
+        command = "INSPECT {} {}\r\n".format(queue_name, ident)
+        self._send(command)
+        raw, body = self.decode(self._receive()).split(' body=', 1)
+        fields = dict(pair.split('=', 1) for pair in raw.split(' '))
+        fields['body'] = body
+        return fields
+
+    def scan(self, queue_name, cursor=0, state=None, min_age=None,
+             max_age=None, count=None):
+        if self.sock is None:
+            self.connect()
+
+        command = "SCAN {} {}".format(queue_name, cursor)
+        filters = (
+            ('STATE', state),
+            ('MINAGE', min_age),
+            ('MAXAGE', max_age),
+            ('COUNT', count),
+        )
+
+        for name, value in filters:
+            if value is not None:
+                command += " {} {}".format(name, value)
+
+        self._send(command + "\r\n")
+        resp = self.decode(self._receive())
+        entries = [tuple(raw.split(' ', 2)) for raw in resp[1:]]
+        return int(resp[0]), entries
+
+    def add(self, queue_name, body, retries=0, key=None, ident=None,
+            attrs=None, group=None):
+        if self.sock is None:
+            self.connect()
+
+        options = ""
+
+        if key is not None:
+            options += "KEY {} ".format(key)
+
+        if ident is not None:
+            options += "ID {} ".format(ident)
+
+        if group is not None:
+            options += "GROUP {} ".format(group)
+
+        for name, value in sorted((attrs or {}).items()):
+            options += "ATTR {}={} ".format(name, value)
+
+        # The options come before the retries, so the body is sent as-is.
+        command = "ADD {} {}{} {}\r\n".format(
             queue_name,
+            options,
             retries,
             body
         )
         self._send(command)
         return self.decode(self._receive())
 
-    def reserve(self, queue_name):
+    def reserve(self, queue_name, timeout=None, with_attrs=False):
         if self.sock is None:
             self.connect()
 
-        command = "RESERVE {}\r\n".format(queue_name)
+        command = "RESERVE {}".format(queue_name)
+
+        if timeout is not None:
+            command += " {}".format(timeout)
+
+        if not with_attrs:
+            self._send(command + "\r\n")
+            raw_body = self.decode(self._receive())
+            ident, receipt, body = raw_body.split(' ', 2)
+            return ident, receipt, body
+
+        # With ``ATTRS``, the attributes follow the item as an array.
+        self._send(command + " ATTRS\r\n")
+        resp = self.decode(self._receive())
+        ident, receipt, body = resp[0].split(' ', 2)
+        attrs = dict(raw.split('=', 1) for raw in resp[1:])
+        return ident, receipt, body, attrs
+
+    def touch(self, queue_name, ident, receipt, timeout=None):
+        if self.sock is None:
+            self.connect()
+
+        if timeout is None:
+            command = "TOUCH {} {} {}\r\n".format(queue_name, ident, receipt)
+        else:
+            command = "TOUCH {} {} {} {}\r\n".format(
+                queue_name,
+                ident,
+                receipt,
+                timeout
+            )
+
         self._send(command)
-        raw_body = self.decode(self._receive())
-        ident, body = raw_body.split(' ', 1)
-        return ident, body
+        return self.decode(self._receive())
 
-    def retry(self, queue_name, ident):
+    def retry(self, queue_name, ident, receipt):
         if self.sock is None:
             self.connect()
 
-        command = "RETRY {} {}\r\n".format(queue_name, ident)
+        command = "RETRY {} {} {}\r\n".format(queue_name, ident, receipt)
         self._send(command)
         return self.decode(self._receive())
 
-    def done(self, queue_name, ident):
+    def release(self, queue_name, ident, receipt, delay=None):
         if self.sock is None:
             self.connect()
 
-        command = "DONE {} {}\r\n".format(queue_name, ident)
+        if delay is None:
+            command = "RELEASE {} {} {}\r\n".format(queue_name, ident, receipt)
+        else:
+            command = "RELEASE {} {} {} {}\r\n".format(
+                queue_name,
+                ident,
+                receipt,
+                delay
+            )
+
+        self._send(command)
+        return self.decode(self._receive())
+
+    def done(self, queue_name, ident, receipt):
+        if self.sock is None:
+            self.connect()
+
+        command = "DONE {} {} {}\r\n".format(queue_name, ident, receipt)
+        self._send(command)
+        return self.decode(self._receive())
+
+    def purge(self, queue_name, state='all'):
+        if self.sock is None:
+            self.connect()
+
+        command = "PURGE {} {}\r\n".format(queue_name, state)
+        self._send(command)
+        return self.decode(self._receive())
+
+    def remove(self, queue_name, ident):
+        if self.sock is None:
+            self.connect()
+
+        command = "REMOVE {} {}\r\n".format(queue_name, ident)
+        self._send(command)
+        return self.decode(self._receive())
+
+    def move(self, src_queue, dst_queue, count=None, ident=None):
+        if self.sock is None:
+            self.connect()
+
+        command = "MOVE {} {}".format(src_queue, dst_queue)
+
+        if ident is not None:
+            command += " ID {}".format(ident)
+        elif count is not None:
+            command += " {}".format(count)
+
+        self._send(command + "\r\n")
+        return self.decode(self._receive())
+
+    def pause(self, queue_name):
+        if self.sock is None:
+            self.connect()
+
+        command = "PAUSE {}\r\n".format(queue_name)
+        self._send(command)
+        return self.decode(self._receive())
+
+    def resume(self, queue_name):
+        if self.sock is None:
+            self.connect()
+
+        command = "RESUME {}\r\n".format(queue_name)
         self._send(command)
         return self.decode(self._receive())
 
+    def queues(self):
+        if self.sock is None:
+            self.connect()
+
+        self._send("QUEUES\r\n")
+        queues = []
+
+        for raw in self.decode(self._receive()):
+            name, length, paused = raw.split(' ')
+            queues.append((
+                name,
+                int(length.split('=', 1)[1]),
+                paused.split('=', 1)[1] == 'true'
+            ))
+
+        return queues
+
     def close(self):
         if self.sock is None:
             self.connect()
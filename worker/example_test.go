@@ -0,0 +1,31 @@
+package worker_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/toastdriven/takeanumber/client"
+	"github.com/toastdriven/takeanumber/worker"
+)
+
+func ExampleWorker() {
+	c := client.New("localhost:13331")
+	defer c.Close()
+
+	w := worker.New(c)
+	// Process up to 4 items at a time from each queue.
+	w.Concurrency = 4
+
+	w.Handle("emails", func(ctx context.Context, i *client.Item) error {
+		fmt.Println(i.Body)
+
+		// Returning an error marks the item to be retried.
+		return nil
+	})
+
+	// Runs until SIGTERM/SIGINT, then lets in-flight items finish.
+	err := w.RunUntilSignal()
+
+	if err != nil {
+		// Bad things happened. Bail out.
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 Daniel Lindsley. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package worker implements a pool of goroutines that process queue items.
+
+A Handler is registered for each queue. The Worker reserves items from those
+queues, hands them to the Handler & marks them as done if it succeeds or to be
+retried if it fails. While a Handler runs, its reservation is kept alive with
+TOUCH.
+
+When the Worker is stopped, no more items are reserved, but items already
+being handled are allowed to finish.
+*/
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/toastdriven/takeanumber/client"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Handler processes a single reserved item.
+//
+// Returning nil marks the item as done. Returning an error (or panicking)
+// marks the item to be retried.
+type Handler func(ctx context.Context, i *client.Item) error
+
+// The Worker itself.
+type Worker struct {
+	Client       *client.Client
+	Concurrency  int
+	Lease        time.Duration
+	PollInterval time.Duration
+	handlers     map[string]Handler
+}
+
+// Registers the Handler for a queue.
+//
+// Accepts the name (string) of the queue & the Handler to call for each item.
+// Registering a queue again replaces its Handler.
+func (w *Worker) Handle(queue string, h Handler) {
+	w.handlers[queue] = h
+}
+
+// Calls the Handler, turning a panic into an error.
+func (w *Worker) call(ctx context.Context, h Handler, i *client.Item) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Handler panicked: %v", r)
+		}
+	}()
+
+	return h(ctx, i)
+}
+
+// Keeps the reservation on an item alive until stop is closed.
+//
+// The reservation is touched every half Lease.
+func (w *Worker) extend(queue string, i *client.Item, stop chan bool) {
+	ticker := time.NewTicker(w.Lease / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), w.Lease/2)
+			err := w.Client.Touch(ctx, queue, i.Id, i.Receipt, w.Lease)
+			cancel()
+
+			if err != nil {
+				log.Printf("worker: couldn't extend %s %s: %v", queue, i.Id, err)
+			}
+		}
+	}
+}
+
+// Processes a single reserved item.
+//
+// The Handler is run with the base context, so that stopping the Worker
+// doesn't interrupt items that are already being handled.
+func (w *Worker) process(base context.Context, queue string, h Handler, i *client.Item) {
+	stop := make(chan bool)
+
+	if w.Lease > 0 {
+		go w.extend(queue, i, stop)
+	}
+
+	err := w.call(base, h, i)
+	close(stop)
+
+	ctx := context.Background()
+
+	// A zero Timeout means the Client never times out, so there's no
+	// deadline to set.
+	if w.Client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Client.Timeout)
+		defer cancel()
+	}
+
+	if err != nil {
+		log.Printf("worker: %s %s failed: %v", queue, i.Id, err)
+		err = w.Client.Retry(ctx, queue, i.Id, i.Receipt)
+
+		if err != nil && err != client.NoRetries {
+			log.Printf("worker: couldn't retry %s %s: %v", queue, i.Id, err)
+		}
+
+		return
+	}
+
+	err = w.Client.Done(ctx, queue, i.Id, i.Receipt)
+
+	if err != nil {
+		log.Printf("worker: couldn't mark %s %s done: %v", queue, i.Id, err)
+	}
+}
+
+// Reserves & processes items from a queue until ctx is done.
+func (w *Worker) loop(ctx context.Context, base context.Context, queue string, h Handler) {
+	for ctx.Err() == nil {
+		i, err := w.Client.Reserve(ctx, queue, w.Lease)
+
+		if err == nil {
+			w.process(base, queue, h, i)
+			continue
+		}
+
+		if err != client.EmptyQueue && ctx.Err() == nil {
+			log.Printf("worker: couldn't reserve from %s: %v", queue, err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(w.PollInterval):
+		}
+	}
+}
+
+// Runs the Worker.
+//
+// Starts Concurrency goroutines for each registered queue & processes items
+// until ctx is done. Once it is, no more items are reserved & Run waits for
+// the items already being handled to finish before returning.
+func (w *Worker) Run(ctx context.Context) error {
+	if len(w.handlers) == 0 {
+		return errors.New("No handlers registered.")
+	}
+
+	base := context.WithoutCancel(ctx)
+	wg := &sync.WaitGroup{}
+
+	for queue, h := range w.handlers {
+		for n := 0; n < w.Concurrency; n++ {
+			wg.Add(1)
+
+			go func(queue string, h Handler) {
+				defer wg.Done()
+				w.loop(ctx, base, queue, h)
+			}(queue, h)
+		}
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// Runs the Worker until the process receives SIGTERM or SIGINT.
+//
+// See Run for how the Worker drains once a signal arrives.
+func (w *Worker) RunUntilSignal() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return w.Run(ctx)
+}
+
+// New creates a new Worker instance.
+//
+// Accepts the Client to use. By default, each queue is processed by a single
+// goroutine, reservations are leased for 30 seconds & empty queues are polled
+// every second.
+func New(c *client.Client) *Worker {
+	handlers := map[string]Handler{}
+	return &Worker{
+		Client:       c,
+		Concurrency:  1,
+		Lease:        30 * time.Second,
+		PollInterval: time.Second,
+		handlers:     handlers,
+	}
+}
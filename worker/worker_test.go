@@ -0,0 +1,166 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"github.com/toastdriven/takeanumber/client"
+	"github.com/toastdriven/takeanumber/server"
+	"github.com/toastdriven/takeanumber/worker"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs an in-process server on an ephemeral port.
+//
+// Returns the address it's listening on.
+func startServer(t *testing.T) string {
+	s := server.New(0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal("Couldn't listen:", err)
+	}
+
+	go s.Serve(l)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return l.Addr().String()
+}
+
+func TestWorker(t *testing.T) {
+	c := client.New(startServer(t))
+	defer c.Close()
+	ctx := context.Background()
+
+	c.Add(ctx, "test_queue", "ok 1", 0)
+	c.Add(ctx, "test_queue", "fail", 1)
+	c.Add(ctx, "test_queue", "ok 2", 0)
+
+	lock := &sync.Mutex{}
+	seen := map[string]int{}
+	finished := make(chan bool)
+
+	w := worker.New(c)
+	w.Concurrency = 2
+	w.PollInterval = 10 * time.Millisecond
+	w.Handle("test_queue", func(ctx context.Context, i *client.Item) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		seen[i.Body]++
+
+		if seen["ok 1"]+seen["ok 2"]+seen["fail"] == 4 {
+			close(finished)
+		}
+
+		if i.Body == "fail" {
+			return errors.New("Failed on purpose.")
+		}
+
+		return nil
+	})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-finished
+		cancel()
+	}()
+
+	if err := w.Run(runCtx); err != nil {
+		t.Fatal("Run failed:", err)
+	}
+
+	if seen["ok 1"] != 1 || seen["ok 2"] != 1 {
+		t.Error("Items weren't handled once each, saw:", seen)
+	}
+
+	if seen["fail"] != 2 {
+		t.Error("Failing item wasn't retried, saw:", seen["fail"])
+	}
+
+	length, _ := c.Len(ctx, "test_queue")
+
+	if length != 0 {
+		t.Error("Queue should be empty, saw:", length)
+	}
+}
+
+func TestWorkerDrain(t *testing.T) {
+	c := client.New(startServer(t))
+	defer c.Close()
+	ctx := context.Background()
+
+	c.Add(ctx, "test_queue", "slow", 0)
+	c.Add(ctx, "test_queue", "never", 0)
+
+	started := make(chan bool)
+	w := worker.New(c)
+	w.Lease = time.Second
+	w.PollInterval = 10 * time.Millisecond
+	w.Handle("test_queue", func(ctx context.Context, i *client.Item) error {
+		close(started)
+
+		// Outlast the lease, so it has to be extended.
+		time.Sleep(1500 * time.Millisecond)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return nil
+	})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if err := w.Run(runCtx); err != nil {
+		t.Fatal("Run failed:", err)
+	}
+
+	i, err := c.Reserve(ctx, "test_queue", 0)
+
+	if err != nil || i.Body != "never" {
+		t.Error("Only the remaining item should be left, saw:", i, err)
+	}
+
+	if _, err := c.Reserve(ctx, "test_queue", 0); err != client.EmptyQueue {
+		t.Error("The in-flight item should have been marked done, saw:", err)
+	}
+}
+
+func TestWorkerNoTimeout(t *testing.T) {
+	c := client.New(startServer(t))
+	c.Timeout = 0
+	defer c.Close()
+	ctx := context.Background()
+
+	id, _ := c.Add(ctx, "test_queue", "ok", 0)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	w := worker.New(c)
+	w.PollInterval = 10 * time.Millisecond
+	w.Handle("test_queue", func(ctx context.Context, i *client.Item) error {
+		cancel()
+		return nil
+	})
+
+	if err := w.Run(runCtx); err != nil {
+		t.Fatal("Run failed:", err)
+	}
+
+	if _, err := c.Inspect(ctx, "test_queue", id); err != client.NoSuchId {
+		t.Error("The item should have been marked done, saw:", err)
+	}
+}
+
+func TestWorkerNoHandlers(t *testing.T) {
+	w := worker.New(client.New("127.0.0.1:0"))
+
+	if w.Run(context.Background()) == nil {
+		t.Error("Running without handlers should fail.")
+	}
+}